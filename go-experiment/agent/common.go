@@ -1,9 +1,12 @@
 package agent
 
 import (
+	"flag"
 	"fmt"
 	"github.com/opennetworkinglab/onos-warden/util"
 	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc/credentials"
+	"os"
 )
 
 type Worker interface {
@@ -11,17 +14,30 @@ type Worker interface {
 	Handle(req *warden.ClusterRequest)
 	Start()
 	Teardown()
+	// Describes the clusters hosted by the worker; the agent fills in its name and version
+	Registration() *warden.AgentRegistration
 }
 
+// Version of the agent reported to the warden
+const Version = "0.1"
+
 type agent struct {
 	grpc   WardenClient
 	worker Worker
 }
 
-// TODO: also pass in the Warden server IP address
+var (
+	wardenAddr = flag.String("warden", "127.0.0.1:1234", "address of the warden server")
+	agentName  = flag.String("name", "", "unique name of this agent; defaults to <hostname>-<cluster type>")
+	tlsFlags   = util.AddTLSFlags()
+)
+
+// Runs the worker until interrupted; parses the command-line flags, if the caller has not already
 func Run(worker Worker, err error) {
 	a := agent{}
-	address := "127.0.0.1:1234"
+	if !flag.Parsed() {
+		flag.Parse()
+	}
 
 	a.worker = worker
 	if err != nil {
@@ -30,7 +46,26 @@ func Run(worker Worker, err error) {
 		fmt.Println("Started agent worker")
 	}
 
-	a.grpc, err = NewWardenClient(address, a.worker, nil)
+	var creds credentials.TransportCredentials
+	if tlsFlags.Enabled() {
+		creds, err = tlsFlags.ClientCredentials()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	reg := worker.Registration()
+	reg.Version = Version
+	reg.Name = *agentName
+	if reg.Name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			panic(err)
+		}
+		reg.Name = host + "-" + reg.ClusterType
+	}
+
+	a.grpc, err = NewWardenClient(*wardenAddr, reg, a.worker, creds)
 	if err != nil {
 		panic(err)
 	} else {
@@ -0,0 +1,66 @@
+package container
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	args := []string{"sed", "-i", "s/127.0.1.1.*/127.0.1.1   onos-1/", "/etc/hosts", "it's", ""}
+	expected := `sed -i 's/127.0.1.1.*/127.0.1.1   onos-1/' /etc/hosts 'it'\''s' ''`
+	if q := Quote(args); q != expected {
+		t.Errorf("Expected %s, got %s", expected, q)
+	}
+}
+
+func TestCreateNode(t *testing.T) {
+	r := &Recorder{Reply: func(node string, step int, cmd string) (string, error) {
+		return "base-onos\nalpha-1\n", nil
+	}}
+	h := &Host{Runner: r.Node("alpha-1")}
+	tmpl := &Template{Clone: CloneOptions{FSSize: "10G"}, Gateway: "10.0.1.1", User: "sdn"}
+	keys := Keys{Authorized: []string{"ssh-rsa AAAA tom"}, Private: "PRIVATE", Public: "PUBLIC"}
+	if err := h.CreateNode(tmpl, Node{Name: "alpha-1", Base: "base-onos", IP: "10.0.1.101"}, keys); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"sudo lxc-ls -1",
+		"sudo lxc-stop -n alpha-1",
+		"sudo lxc-destroy -n alpha-1",
+		"sudo lxc-copy -n base-onos -N alpha-1 --fssize 10G",
+		`sudo tee -a /var/lib/lxc/alpha-1/config < "lxc.network.ipv4 = 10.0.1.101/24\nlxc.network.ipv4.gateway = 10.0.1.1\n"`,
+		"sudo lxc-start -d -n alpha-1",
+		"sudo lxc-wait -n alpha-1 -s RUNNING -t 10",
+		"sudo lxc-attach -n alpha-1 -- sed -i 's/127.0.1.1.*/127.0.1.1   alpha-1/' /etc/hosts",
+		"sudo lxc-attach -n alpha-1 -- ping -c1 8.8.8.8",
+		`sudo lxc-attach -n alpha-1 -- tee /home/sdn/.ssh/id_rsa < "PRIVATE"`,
+		"sudo lxc-attach -n alpha-1 -- chmod 400 /home/sdn/.ssh/id_rsa",
+		"sudo lxc-attach -n alpha-1 -- chown sdn:sdn /home/sdn/.ssh/id_rsa",
+		`sudo lxc-attach -n alpha-1 -- tee /home/sdn/.ssh/id_rsa.pub < "PUBLIC"`,
+		"sudo lxc-attach -n alpha-1 -- chmod 400 /home/sdn/.ssh/id_rsa.pub",
+		"sudo lxc-attach -n alpha-1 -- chown sdn:sdn /home/sdn/.ssh/id_rsa.pub",
+		`sudo lxc-attach -n alpha-1 -- tee -a /home/sdn/.ssh/authorized_keys < "ssh-rsa AAAA tom"`,
+	}
+	if cmds := r.Transcript("alpha-1"); strings.Join(cmds, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected commands:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(cmds, "\n"))
+	}
+}
+
+func TestCreateNodeFailure(t *testing.T) {
+	r := &Recorder{Reply: func(node string, step int, cmd string) (string, error) {
+		if strings.Contains(cmd, "lxc-start") {
+			return "", errors.New("exit status 1")
+		}
+		return "", nil
+	}}
+	h := &Host{Runner: r.Node("alpha-1")}
+	err := h.CreateNode(&Template{User: "sdn"}, Node{Name: "alpha-1", Base: "base-onos", IP: "10.0.1.101"}, Keys{})
+	if err == nil || err.Error() != "lxc-start -d -n alpha-1: exit status 1" {
+		t.Errorf("Expected lxc-start to fail, got %v", err)
+	}
+	// the container did not exist, so it was not destroyed first, and nothing ran after the failure
+	if cmds := r.Transcript("alpha-1"); len(cmds) != 4 || cmds[3] != "sudo lxc-start -d -n alpha-1" {
+		t.Errorf("Expected to stop at lxc-start, got %v", cmds)
+	}
+}
@@ -0,0 +1,90 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Manages the containers of a host with the LXC tools, which are run with sudo
+type Host struct {
+	Runner Runner
+}
+
+// How a container is cloned from its base container
+type CloneOptions struct {
+	Snapshot string // snapshot of the base to clone from, if any
+	Backing  string // backing store of the clone, e.g. overlay
+	FSSize   string // size of the clone's file system, e.g. 10G
+}
+
+func (h *Host) run(stdin string, args ...string) (string, error) {
+	args = append([]string{"sudo"}, args...)
+	stdout, stderr, err := h.Runner.Run(args, stdin)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", strings.Join(args[1:], " "), err)
+		if stderr = strings.TrimSpace(stderr); stderr != "" {
+			err = fmt.Errorf("%v: %s", err, stderr)
+		}
+		return stdout, err
+	}
+	return stdout, nil
+}
+
+// Clones the named container from the base container
+func (h *Host) Create(base, name string, opts CloneOptions) error {
+	args := []string{"lxc-copy", "-n", base}
+	if opts.Snapshot != "" {
+		args = append(args, "-s", opts.Snapshot)
+	}
+	if opts.Backing != "" {
+		args = append(args, "-B", opts.Backing)
+	}
+	args = append(args, "-N", name)
+	if opts.FSSize != "" {
+		args = append(args, "--fssize", opts.FSSize)
+	}
+	_, err := h.run("", args...)
+	return err
+}
+
+// Configures the static address and the gateway of the container; it takes effect when the
+// container starts
+func (h *Host) SetIP(name, ip, gateway string) error {
+	config := fmt.Sprintf("lxc.network.ipv4 = %s/24\nlxc.network.ipv4.gateway = %s\n", ip, gateway)
+	_, err := h.run(config, "tee", "-a", "/var/lib/lxc/"+name+"/config")
+	return err
+}
+
+// Starts the container and waits until it is running
+func (h *Host) Start(name string, timeout time.Duration) error {
+	if _, err := h.run("", "lxc-start", "-d", "-n", name); err != nil {
+		return err
+	}
+	_, err := h.run("", "lxc-wait", "-n", name, "-s", "RUNNING", "-t", fmt.Sprint(int(timeout.Seconds())))
+	return err
+}
+
+// Runs the command inside the container and provides stdin to it; returns its output
+func (h *Host) Exec(name, stdin string, args ...string) (string, error) {
+	return h.run(stdin, append([]string{"lxc-attach", "-n", name, "--"}, args...)...)
+}
+
+func (h *Host) Stop(name string) error {
+	_, err := h.run("", "lxc-stop", "-n", name)
+	return err
+}
+
+func (h *Host) Destroy(name string) error {
+	_, err := h.run("", "lxc-destroy", "-n", name)
+	return err
+}
+
+// Returns the names of all the containers of the host
+func (h *Host) List() ([]string, error) {
+	out, err := h.run("", "lxc-ls", "-1")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
@@ -0,0 +1,110 @@
+package container
+
+import (
+	"fmt"
+	"time"
+)
+
+// How long a node may take to start running
+const startTimeout = 10 * time.Second
+
+// Describes how the nodes of a cluster are cloned and set up
+type Template struct {
+	Clone   CloneOptions
+	Gateway string // gateway of the nodes' network
+	User    string // user of the nodes whose SSH keys are set up
+}
+
+// Node of a cluster, cloned from its base container
+type Node struct {
+	Name string
+	Base string
+	IP   string
+}
+
+// SSH keys to set up for the user of a node
+type Keys struct {
+	Authorized []string // public keys allowed to log in as the user
+	Private    string   // key pair of the user, if any, with which nodes log into each other
+	Public     string
+}
+
+// Creates the node's container, replacing any stale container of the same name, starts it and
+// sets up the user's keys
+func (h *Host) CreateNode(t *Template, n Node, keys Keys) error {
+	if err := h.DestroyNode(n.Name); err != nil {
+		return err
+	}
+	if err := h.Create(n.Base, n.Name, t.Clone); err != nil {
+		return err
+	}
+	if err := h.SetIP(n.Name, n.IP, t.Gateway); err != nil {
+		return err
+	}
+	if err := h.Start(n.Name, startTimeout); err != nil {
+		return err
+	}
+	hosts := fmt.Sprintf("s/127.0.1.1.*/127.0.1.1   %s/", n.Name)
+	if _, err := h.Exec(n.Name, "", "sed", "-i", hosts, "/etc/hosts"); err != nil {
+		return err
+	}
+	// Validate that the node is reachable from the outside before handing it out
+	if _, err := h.Exec(n.Name, "", "ping", "-c1", "8.8.8.8"); err != nil {
+		return err
+	}
+	if keys.Private != "" {
+		if err := h.addKeyPair(t.User, n.Name, keys.Private, keys.Public); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys.Authorized {
+		if _, err := h.Exec(n.Name, key, "tee", "-a", "/home/"+t.User+"/.ssh/authorized_keys"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Host) addKeyPair(user, name, privKey, pubKey string) error {
+	owner := user + ":" + user
+	for _, f := range []struct{ path, key string }{
+		{"/home/" + user + "/.ssh/id_rsa", privKey},
+		{"/home/" + user + "/.ssh/id_rsa.pub", pubKey},
+	} {
+		if _, err := h.Exec(name, f.key, "tee", f.path); err != nil {
+			return err
+		}
+		if _, err := h.Exec(name, "", "chmod", "400", f.path); err != nil {
+			return err
+		}
+		if _, err := h.Exec(name, "", "chown", owner, f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Logs into the remote address from the node as the user, so that the node accepts the remote's
+// host key
+func (h *Host) AcceptHostKey(user, name, remoteIp string) error {
+	_, err := h.Exec(name, "", "sudo", "-u", user, "ssh", "-n", "-o", "StrictHostKeyChecking=no",
+		"-o", "PasswordAuthentication=no", user+"@"+remoteIp, "hostname")
+	return err
+}
+
+// Stops and destroys the node's container, if it exists
+func (h *Host) DestroyNode(name string) error {
+	names, err := h.List()
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n != name {
+			continue
+		}
+		// the container may not be running
+		h.Stop(name)
+		return h.Destroy(name)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package container
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Fake runner for tests, which records the commands run for each node instead of running them
+type Recorder struct {
+	// Returns the output of the node's command, given the index of the command in the node's
+	// transcript, or an error to simulate its failure; every command succeeds without output if nil
+	Reply func(node string, step int, cmd string) (stdout string, err error)
+
+	mux         sync.Mutex
+	transcripts map[string][]string
+}
+
+type recorderNode struct {
+	r    *Recorder
+	name string
+}
+
+// Returns the runner of the commands for the named node
+func (r *Recorder) Node(name string) Runner {
+	return recorderNode{r, name}
+}
+
+// Returns the commands run for the named node, in order, each followed by its quoted input, if any
+func (r *Recorder) Transcript(name string) []string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return append([]string(nil), r.transcripts[name]...)
+}
+
+func (n recorderNode) Run(args []string, stdin string) (stdout, stderr string, err error) {
+	cmd := Quote(args)
+	if stdin != "" {
+		cmd += fmt.Sprintf(" < %q", stdin)
+	}
+	n.r.mux.Lock()
+	if n.r.transcripts == nil {
+		n.r.transcripts = make(map[string][]string)
+	}
+	step := len(n.r.transcripts[n.name])
+	n.r.transcripts[n.name] = append(n.r.transcripts[n.name], cmd)
+	n.r.mux.Unlock()
+
+	if n.r.Reply == nil {
+		return "", "", nil
+	}
+	stdout, err = n.r.Reply(n.name, step, cmd)
+	return stdout, "", err
+}
@@ -0,0 +1,90 @@
+// Package container manages the LXC containers of a host, either on the local machine or over SSH,
+// so that the agents share one way of provisioning their nodes.
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/agent"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Runs commands on the host of the containers
+type Runner interface {
+	// Runs the command and provides stdin to it; err is != nil if it cannot be run or its exit
+	// status is != 0
+	Run(args []string, stdin string) (stdout, stderr string, err error)
+}
+
+// Runs commands on the local machine
+type Local struct{}
+
+func (Local) Run(args []string, stdin string) (stdout, stderr string, err error) {
+	var outbuf, errbuf bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	err = cmd.Run()
+	return outbuf.String(), errbuf.String(), err
+}
+
+// Runs commands on a remote machine, through the shell of the SSH server
+type SSH struct {
+	Client *ssh.Client
+}
+
+func (s SSH) Run(args []string, stdin string) (stdout, stderr string, err error) {
+	return agent.RunCmd(s.Client, Quote(args), stdin)
+}
+
+// Returns the command line that runs the given arguments in a POSIX shell
+func Quote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Characters that need no quoting in a shell word
+const safeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@,+%"
+
+func quote(arg string) string {
+	if arg != "" && strings.Trim(arg, safeChars) == "" {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+type logged struct {
+	runner Runner
+	log    io.Writer
+}
+
+// Returns a runner that writes each command, its input and its output to the log
+func Logged(r Runner, log io.Writer) Runner {
+	return logged{r, log}
+}
+
+func (l logged) Run(args []string, stdin string) (stdout, stderr string, err error) {
+	fmt.Fprint(l.log, Quote(args))
+	if stdin != "" {
+		fmt.Fprint(l.log, " < ", stdin)
+	}
+	fmt.Fprintln(l.log)
+	stdout, stderr, err = l.runner.Run(args, stdin)
+	if stdout != "" {
+		fmt.Fprintln(l.log, "STDOUT:", stdout)
+	}
+	if stderr != "" {
+		fmt.Fprintln(l.log, "STDERR:", stderr)
+	}
+	if err != nil {
+		fmt.Fprintln(l.log, "ERROR:", err)
+	}
+	return
+}
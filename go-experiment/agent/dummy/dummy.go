@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/opennetworkinglab/onos-warden/agent"
 	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc/codes"
 	"net"
 	"reflect"
 	"sync"
@@ -16,6 +17,9 @@ const (
 	clusterType = "dummy"
 )
 
+// Maximum number of controller nodes for each dummy cell; the cells differ in size to exercise best fit
+var cellSizes = [numCells]uint32{3, 5, 7}
+
 type client struct {
 	grpc     agent.WardenClient
 	cells    map[string]warden.ClusterAdvertisement
@@ -37,6 +41,11 @@ func (c *client) Start() {
 			ClusterType: clusterType,
 			State:       warden.ClusterAdvertisement_AVAILABLE,
 			HeadNodeIP:  "1.2.3.4",
+			Capacity: &warden.ClusterAdvertisement_Capacity{
+				MaxControllerNodes: cellSizes[i],
+				Cpus:               cellSizes[i] * 2,
+				MemoryMb:           uint64(cellSizes[i]) * 2048,
+			},
 		})
 	}
 }
@@ -45,6 +54,13 @@ func (c *client) Bind(client agent.WardenClient) {
 	c.grpc = client
 }
 
+func (c *client) Registration() *warden.AgentRegistration {
+	return &warden.AgentRegistration{
+		ClusterType:  clusterType,
+		Capabilities: []string{"reserve", "extend", "return", "ack"},
+	}
+}
+
 func (c *client) Teardown() {
 	c.mux.Lock()
 	defer c.mux.Unlock()
@@ -58,29 +74,29 @@ func (c *client) Teardown() {
 
 func (c *client) Handle(req *warden.ClusterRequest) {
 	if req.ClusterType != "" && req.ClusterType != clusterType {
-		fmt.Println("Cannot handle cluster type", req.ClusterType)
+		c.reject(req, codes.InvalidArgument, "Cannot handle cluster type "+req.ClusterType)
 		return
 	}
 	ad, ok := c.getRequest(req.ClusterId, req.RequestId)
 	if !ok {
-		fmt.Println("Cannot find cluster id", req.ClusterId)
+		c.reject(req, codes.NotFound, "Cannot find cluster id "+req.ClusterId)
 		return
 	}
 	if ad.RequestId != "" && ad.RequestId != req.RequestId {
-		fmt.Printf("Requested id %s does not match exisiting id %s\n", req.RequestId, ad.RequestId)
+		c.reject(req, codes.FailedPrecondition, fmt.Sprintf("Requested id %s does not match exisiting id %s", req.RequestId, ad.RequestId))
 		return
 	}
 
 	switch req.Type {
 	case warden.ClusterRequest_RESERVE:
 		if ad.ReservationInfo != nil {
-			fmt.Println("Could not reserve cell", ad, req)
+			c.reject(req, codes.FailedPrecondition, "Could not reserve cell "+ad.ClusterId)
 			return
 		}
 		ad.State = warden.ClusterAdvertisement_RESERVED
 		ad.RequestId = req.RequestId
 		if req.Spec == nil {
-			fmt.Println("req spec is nil", req)
+			c.reject(req, codes.InvalidArgument, "req spec is nil")
 			return
 		}
 		ad.ReservationInfo = &warden.ClusterAdvertisement_ReservationInfo{
@@ -98,15 +114,27 @@ func (c *client) Handle(req *warden.ClusterRequest) {
 				Ip: ip.String(),
 			}
 		}
+		c.ack(req, warden.RequestAck_ACCEPTED, "reserved cell "+ad.ClusterId)
 		go func(a warden.ClusterAdvertisement) {
-			// update a copy after 5 seconds to simulate provisioning
-			time.Sleep(5 * time.Second)
+			// update a copy after 5 seconds to simulate provisioning, one node at a time
+			n := uint32(len(a.Nodes))
+			if n == 0 {
+				time.Sleep(5 * time.Second)
+			}
+			for i := uint32(1); i <= n; i++ {
+				time.Sleep(5 * time.Second / time.Duration(n))
+				msg := fmt.Sprintf("node %d/%d ready", i, n)
+				if err := c.grpc.ReportProgress(req, i, n, msg); err != nil {
+					fmt.Println("Unable to report progress of request", req.RequestId, err)
+				}
+			}
 			a.State = warden.ClusterAdvertisement_READY
 			c.updateRequest(&a)
+			c.ack(req, warden.RequestAck_COMPLETED, "provisioned cell "+a.ClusterId)
 		}(ad)
 	case warden.ClusterRequest_EXTEND:
 		if ad.ReservationInfo == nil {
-			fmt.Println("Could not extend reservation; reservation info missing", req)
+			c.reject(req, codes.FailedPrecondition, "Could not extend reservation; reservation info missing")
 			return
 		}
 		// Update the duration field
@@ -122,6 +150,25 @@ func (c *client) Handle(req *warden.ClusterRequest) {
 	}
 	fmt.Println("Updating", ad)
 	c.updateRequest(&ad)
+	if req.Type != warden.ClusterRequest_RESERVE {
+		// reservations complete once the cell has been provisioned
+		c.ack(req, warden.RequestAck_COMPLETED, fmt.Sprintf("%v of cell %s done", req.Type, ad.ClusterId))
+	}
+}
+
+// Logs the refused request and reports it to the warden
+func (c *client) reject(req *warden.ClusterRequest, code codes.Code, msg string) {
+	fmt.Println(msg, req)
+	if err := c.grpc.Reject(req, code, msg); err != nil {
+		fmt.Println("Unable to report rejection of request", req.RequestId, err)
+	}
+}
+
+// Tells the warden how far the request has got
+func (c *client) ack(req *warden.ClusterRequest, phase warden.RequestAck_Phase, msg string) {
+	if err := c.grpc.Acknowledge(req, phase, msg); err != nil {
+		fmt.Println("Unable to acknowledge request", req.RequestId, err)
+	}
 }
 
 func (c *client) getRequest(cId, rId string) (w warden.ClusterAdvertisement, retOk bool) {
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	costReservation = "reservation"
+	costInstance    = "instance"
+)
+
+// Record of what a reservation or an instance cost, appended to the cost log when it ends
+type costRecord struct {
+	Kind         string  `json:"kind"`
+	ClusterId    string  `json:"clusterId"`
+	InstanceId   string  `json:"instanceId"`
+	InstanceType string  `json:"instanceType"`
+	UserName     string  `json:"userName,omitempty"`
+	RequestId    string  `json:"requestId,omitempty"`
+	SpotPrice    float64 `json:"spotPrice"` // US dollars per hour
+	Start        int64   `json:"start"`     // seconds since epoch
+	End          int64   `json:"end"`       // seconds since epoch
+	Cost         float64 `json:"cost"`      // US dollars
+}
+
+// Log of cost records kept in a local file, one JSON record per line
+type costLog struct {
+	lock sync.Mutex
+	path string
+}
+
+func (l *costLog) Append(rec costRecord) error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+func readCostLog(r io.Reader) ([]costRecord, error) {
+	var recs []costRecord
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var rec costRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping bad cost record on line %d: %v\n", line, err)
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
+
+// Returns the estimated cost, in US dollars rounded to the cent, of running at the given hourly
+// price from start until end
+func estimateCost(price float64, start, end time.Time) float64 {
+	if price <= 0 || !end.After(start) {
+		return 0
+	}
+	return math.Round(end.Sub(start).Hours()*price*100) / 100
+}
+
+// Returns the current spot price of InstanceType in each availability zone of the region
+func (c *ec2Client) fetchSpotPrices() (map[string]float64, error) {
+	out, err := c.svc.DescribeSpotPriceHistory(&ec2.DescribeSpotPriceHistoryInput{
+		InstanceTypes:       aws.StringSlice([]string{InstanceType}),
+		ProductDescriptions: aws.StringSlice([]string{"Linux/UNIX"}),
+		StartTime:           aws.Time(time.Now()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	prices := make(map[string]float64)
+	for _, p := range out.SpotPriceHistory {
+		if p.AvailabilityZone == nil || p.SpotPrice == nil {
+			continue
+		}
+		price, err := strconv.ParseFloat(*p.SpotPrice, 64)
+		if err != nil {
+			fmt.Println("Failed to parse spot price", *p.SpotPrice, err)
+			continue
+		}
+		prices[*p.AvailabilityZone] = price
+	}
+	return prices, nil
+}
+
+// Fills in the cluster's spot price and the estimated cost of its reservation, if any
+// You must hold c.mux before calling this method
+func (c *ec2Client) priceCluster(cl *cluster) {
+	if price, ok := c.spotPrices[cl.Zone]; ok {
+		cl.SpotPrice = price
+	}
+	if info := cl.ReservationInfo; info != nil && cl.RequestId != "" {
+		info.EstimatedCost = estimateCost(cl.SpotPrice, time.Unix(info.ReservationStartTime, 0), time.Now())
+	}
+}
+
+// Records the cost of the cluster's reservation, which is ending
+func (c *ec2Client) recordReservationCost(cl *cluster) {
+	info := cl.ReservationInfo
+	if info == nil || cl.RequestId == "" {
+		return
+	}
+	start, end := time.Unix(info.ReservationStartTime, 0), time.Now()
+	rec := costRecord{
+		Kind:         costReservation,
+		ClusterId:    cl.ClusterId,
+		InstanceId:   cl.InstanceId,
+		InstanceType: cl.InstanceType,
+		UserName:     info.UserName,
+		RequestId:    cl.RequestId,
+		SpotPrice:    cl.SpotPrice,
+		Start:        start.Unix(),
+		End:          end.Unix(),
+		Cost:         estimateCost(cl.SpotPrice, start, end),
+	}
+	if err := c.costs.Append(rec); err != nil {
+		fmt.Println("Failed to record cost of reservation", cl.RequestId, err)
+	}
+}
+
+// Records the cost of the cluster's instance, which is going away
+func (c *ec2Client) recordInstanceCost(cl *cluster) {
+	if cl.InstanceId == "" || cl.LaunchTime.IsZero() {
+		return
+	}
+	end := time.Now()
+	rec := costRecord{
+		Kind:         costInstance,
+		ClusterId:    cl.ClusterId,
+		InstanceId:   cl.InstanceId,
+		InstanceType: cl.InstanceType,
+		SpotPrice:    cl.SpotPrice,
+		Start:        cl.LaunchTime.Unix(),
+		End:          end.Unix(),
+		Cost:         estimateCost(cl.SpotPrice, cl.LaunchTime, end),
+	}
+	if err := c.costs.Append(rec); err != nil {
+		fmt.Println("Failed to record cost of instance", cl.InstanceId, err)
+	}
+}
+
+// Totals of the cost records that ended in one ISO week, for one user or for all instances
+type costTotal struct {
+	week, user string
+	count      int
+	hours      float64
+	cost       float64
+}
+
+func isoWeek(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+// Aggregates the cost records by week and by user; instance records are totalled per week under
+// the user "*", since they include the time instances spent waiting for reservations
+func aggregateCosts(recs []costRecord) []costTotal {
+	totals := make(map[[2]string]*costTotal)
+	for _, rec := range recs {
+		user := rec.UserName
+		if rec.Kind == costInstance {
+			user = "*"
+		}
+		k := [2]string{isoWeek(time.Unix(rec.End, 0)), user}
+		t, ok := totals[k]
+		if !ok {
+			t = &costTotal{week: k[0], user: k[1]}
+			totals[k] = t
+		}
+		t.count++
+		t.hours += time.Unix(rec.End, 0).Sub(time.Unix(rec.Start, 0)).Hours()
+		t.cost += rec.Cost
+	}
+	list := make([]costTotal, 0, len(totals))
+	for _, t := range totals {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].week != list[j].week {
+			return list[i].week < list[j].week
+		}
+		return list[i].user < list[j].user
+	})
+	return list
+}
+
+// Prints the cost report of the given log, by week and by user
+func printCostReport(path string, out io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	recs, err := readCostLog(f)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "WEEK\tUSER\tCOUNT\tHOURS\tCOST ($)")
+	byUser := make(map[string]*costTotal)
+	for _, t := range aggregateCosts(recs) {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.1f\t%.2f\n", t.week, t.user, t.count, t.hours, t.cost)
+		u, ok := byUser[t.user]
+		if !ok {
+			u = &costTotal{user: t.user}
+			byUser[t.user] = u
+		}
+		u.count += t.count
+		u.hours += t.hours
+		u.cost += t.cost
+	}
+	users := make([]string, 0, len(byUser))
+	for u := range byUser {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	for _, u := range users {
+		t := byUser[u]
+		fmt.Fprintf(w, "total\t%s\t%d\t%.1f\t%.2f\n", t.user, t.count, t.hours, t.cost)
+	}
+	return w.Flush()
+}
@@ -4,29 +4,79 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/opennetworkinglab/onos-warden/agent"
+	"github.com/opennetworkinglab/onos-warden/agent/container"
 	"github.com/opennetworkinglab/onos-warden/warden"
 	"golang.org/x/crypto/ssh"
-	"io"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const SshPort = 822
 
-func writer(cl *cluster, name string) (io.Writer, error) {
+// How the containers of the cluster's nodes are cloned and set up
+var nodeTemplate = container.Template{
+	//TODO make snap0 configurable
+	Clone:   container.CloneOptions{Snapshot: "snap0", Backing: "overlay"},
+	Gateway: "10.0.1.1",
+	//TODO make the user configurable
+	User: "sdn",
+}
+
+// Generates the key pair with which the cluster's nodes log into each other; replaced in tests
+var generateKeyPair = agent.GenerateKeyPair
+
+// Returns the host of the cluster's containers on which the commands for the named node are run
+type nodeHosts func(name string) (*container.Host, error)
+
+// Opens the log of the commands run for the named node; entries are appended, so that the output
+// of a failed step is kept when the node is rolled back
+func nodeLog(cl *cluster, name string) (*os.File, error) {
 	dirpath := fmt.Sprintf("/tmp/%s-%s/", cl.ClusterId, cl.ClusterType)
 	err := os.MkdirAll(dirpath, 0755)
 	if err != nil {
 		return nil, err
 	}
-	filepath := dirpath + name + ".log"
-	f, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE, 0755)
+	return os.OpenFile(dirpath+name+".log", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// Connects to the cluster's instance over SSH; the commands for each node are logged to its own
+// file, which is opened once and closed along with the connection by the returned function
+func (c *ec2Client) connectSSH(cl *cluster) (nodeHosts, func(), error) {
+	connection, err := c.dialCluster(cl)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	var (
+		mu   sync.Mutex
+		logs = make(map[string]*os.File)
+	)
+	hosts := func(name string) (*container.Host, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		log, ok := logs[name]
+		if !ok {
+			var err error
+			if log, err = nodeLog(cl, name); err != nil {
+				return nil, err
+			}
+			logs[name] = log
+		}
+		return &container.Host{Runner: container.Logged(container.SSH{Client: connection}, log)}, nil
+	}
+	done := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, log := range logs {
+			log.Close()
+		}
+		connection.Close()
 	}
-	return f, nil
+	return hosts, done, nil
 }
 
 func (c *ec2Client) dialCluster(cl *cluster) (connection *ssh.Client, err error) {
@@ -54,63 +104,90 @@ func (c *ec2Client) dialCluster(cl *cluster) (connection *ssh.Client, err error)
 	return
 }
 
+// Returns the nodes of the cluster: the mininet node, whose host key the others accept, followed by
+// the ONOS nodes
+func clusterNodes(cl *cluster) []container.Node {
+	nodes := make([]container.Node, cl.Size+1)
+	for i := range nodes {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, IpBase+uint32(i))
+		nodes[i] = container.Node{Name: fmt.Sprintf("onos-%d", i), Base: "ctrl-base", IP: ip.String()}
+	}
+	nodes[0].Name, nodes[0].Base = "onos-n", "test-base"
+	return nodes
+}
 
-func (c *ec2Client) provisionCluster(cl *cluster, userPubKey string) (err error) {
+// Creates the containers of the cluster's nodes; if any of them cannot be created, the containers
+// that were are destroyed and the cluster is left as it was
+func (c *ec2Client) provisionCluster(cl *cluster, userPubKey string, progress progressFunc) (err error) {
 	fmt.Printf("Provisioning cluster %s (%s) at %s\n", cl.ClusterId, cl.InstanceId, cl.HeadNodeIP)
 	// Ensure only one provisioning task occurs at a time
 	cl.provisionMux.Lock()
 	defer cl.provisionMux.Unlock()
 
-	connection, err := c.dialCluster(cl)
+	hosts, done, err := c.connect(cl)
 	if err != nil {
 		return err
 	}
+	defer done()
+	progress(0, 0, "connected to "+cl.HeadNodeIP)
 
-	internalPrivKey, internalPubKey, err := agent.GenerateKeyPair()
+	internalPrivKey, internalPubKey, err := generateKeyPair()
 	if err != nil {
 		return err
 	}
 
-	var wg sync.WaitGroup
-	ip := IpBase
-	//TODO this can be async if acceptHostKey is done after wait group
-	func(ipNum uint32) {
-		name := "onos-n"
-		ip := make(net.IP, 4)
-		binary.BigEndian.PutUint32(ip, ipNum)
-		log, err := writer(cl, name)
+	keys := container.Keys{
+		Authorized: []string{userPubKey, internalPubKey},
+		Private:    internalPrivKey,
+		Public:     internalPubKey,
+	}
+
+	nodes := clusterNodes(cl)
+	createNode := func(n container.Node) error {
+		h, err := hosts(n.Name)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
-		createContainer(connection, log, name, ip.String(), "test-base")
-		addKeyPair(connection, log, name, internalPrivKey, internalPubKey)
-		addAuthorizedKey(connection, log, name, userPubKey)
-		addAuthorizedKey(connection, log, name, internalPubKey)
-		acceptHostKey(connection, log, name, ip.String())
-		//wg.Done() TODO add this back if we make this async
-	}(ip)
-	wg.Add(int(cl.Size)) // wait for onos instance containers
-	for i := 1; i <= int(cl.Size); i++ {
-		ip++
-		go func(i int, ipNum uint32) {
-			name := fmt.Sprintf("onos-%d", i)
-			ip := make(net.IP, 4)
-			binary.BigEndian.PutUint32(ip, ipNum)
-			log, err := writer(cl, name)
-			if err != nil {
-				fmt.Println(err)
+		if err := h.CreateNode(&nodeTemplate, n, keys); err != nil {
+			return err
+		}
+		progress(0, 0, "container "+n.Name+" created")
+		return h.AcceptHostKey(nodeTemplate.User, nodes[0].Name, n.IP)
+	}
+
+	// the mininet node comes first, since the ONOS nodes need its key pair to accept their host keys
+	if err := createNode(nodes[0]); err != nil {
+		err = fmt.Errorf("unable to create node %s: %v", nodes[0].Name, err)
+		c.rollback(hosts, nodes[:1])
+		return err
+	}
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		ready uint32
+		errs  []string
+	)
+	wg.Add(len(nodes) - 1) // wait for onos instance containers
+	for _, n := range nodes[1:] {
+		go func(n container.Node) {
+			defer wg.Done()
+			if err := createNode(n); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("%s: %v", n.Name, err))
+				mu.Unlock()
 				return
 			}
-			createContainer(connection, log, name, ip.String(), "ctrl-base")
-			addKeyPair(connection, log, name, internalPrivKey, internalPubKey)
-			addAuthorizedKey(connection, log, name, userPubKey)
-			addAuthorizedKey(connection, log, name, internalPubKey)
-			acceptHostKey(connection, log, "onos-n", ip.String())
-			wg.Done()
-		}(i, ip)
+			r := atomic.AddUint32(&ready, 1)
+			progress(r, cl.Size, fmt.Sprintf("node %d/%d ready", r, cl.Size))
+		}(n)
 	}
 	wg.Wait()
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		c.rollback(hosts, nodes)
+		return fmt.Errorf("unable to create %d of %d nodes: %s", len(errs), cl.Size, strings.Join(errs, "; "))
+	}
 
 	cl.State = warden.ClusterAdvertisement_READY
 	c.tagInstance(cl.InstanceId, cl)
@@ -118,6 +195,7 @@ func (c *ec2Client) provisionCluster(cl *cluster, userPubKey string) (err error)
 	//FIXME there is something going on here where state != READY
 	updatedCl, err := c.getInstance(cl.InstanceId)
 	if err != nil {
+		c.rollback(hosts, nodes)
 		return err
 	}
 	c.mux.Lock()
@@ -126,160 +204,53 @@ func (c *ec2Client) provisionCluster(cl *cluster, userPubKey string) (err error)
 	return nil
 }
 
+// Destroys the containers of the nodes created before provisioning failed
+func (c *ec2Client) rollback(hosts nodeHosts, nodes []container.Node) {
+	if err := destroyNodes(hosts, nodes); err != nil {
+		fmt.Println("Failed to roll back provisioning:", err)
+	}
+}
+
 func (c *ec2Client) destroyCluster(cl *cluster) error {
 	fmt.Printf("Returning cluster %s (%s) at %s\n", cl.ClusterId, cl.InstanceId, cl.HeadNodeIP)
 	// Ensure only one provisioning task occurs at a time
 	cl.provisionMux.Lock()
 	defer cl.provisionMux.Unlock()
 
-
-	connection, err := c.dialCluster(cl)
+	hosts, done, err := c.connect(cl)
 	if err != nil {
 		return err
 	}
+	defer done()
+	return destroyNodes(hosts, clusterNodes(cl))
+}
 
-	var wg sync.WaitGroup
-	wg.Add(int(cl.Size + 1))
-	ip := IpBase
-	go func(ipNum uint32) {
-		name := "onos-n"
-		ip := make(net.IP, 4)
-		binary.BigEndian.PutUint32(ip, ipNum)
-		log, err := writer(cl, name)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		destroyContainer(connection, log, name, false)
-		wg.Done()
-	}(ip)
-	// wait for onos instance containers
-	for i := 1; i <= int(cl.Size); i++ {
-		ip++
-		go func(i int, ipNum uint32) {
-			name := fmt.Sprintf("onos-%d", i)
-			ip := make(net.IP, 4)
-			binary.BigEndian.PutUint32(ip, ipNum)
-			log, err := writer(cl, name)
+// Destroys the containers of the nodes that exist
+func destroyNodes(hosts nodeHosts, nodes []container.Node) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	wg.Add(len(nodes))
+	for _, n := range nodes {
+		go func(name string) {
+			defer wg.Done()
+			h, err := hosts(name)
+			if err == nil {
+				err = h.DestroyNode(name)
+			}
 			if err != nil {
-				fmt.Println(err)
-				return
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				mu.Unlock()
 			}
-			destroyContainer(connection, log, name, false)
-			wg.Done()
-		}(i, ip)
+		}(n.Name)
 	}
 	wg.Wait()
-	return nil
-}
-
-
-func logAndRunCmd(c *ssh.Client, log io.Writer, cmd, stdin string) (err error) {
-	var stdout, stderr string
-
-	log.Write([]byte(cmd))
-	if stdin != "" {
-		log.Write([]byte(" < "))
-		log.Write([]byte(stdin))
-	}
-	log.Write([]byte("\n"))
-	stdout, stderr, err = agent.RunCmd(c, cmd, stdin)
-	if stdout != "" {
-		log.Write([]byte("STDOUT: "))
-		log.Write([]byte(stdout))
-		log.Write([]byte("\n"))
-	}
-	if stderr != "" {
-		log.Write([]byte("STDERR: "))
-		log.Write([]byte(stderr))
-		log.Write([]byte("\n"))
-	}
-	return
-}
-
-func createContainer(c *ssh.Client, log io.Writer, name, ip, baseImage string) (err error) {
-	// destroy the container if it already exists
-	destroyContainer(c, log, name, false)
-
-	//TODO make snap0 configurable
-	err = logAndRunCmd(c, log, fmt.Sprintf("sudo lxc-copy -n %s -s snap0 -B overlay -N %s", baseImage, name), "")
-	if err != nil {
-		return
-	}
-	err = logAndRunCmd(c, log, fmt.Sprintf("sudo tee -a /var/lib/lxc/%s/config", name),
-		fmt.Sprintf("lxc.network.ipv4 = %s/24\nlxc.network.ipv4.gateway = 10.0.1.1\n", ip))
-	if err != nil {
-		return
-	}
-	err = logAndRunCmd(c, log, fmt.Sprintf("sudo lxc-start -d -n %s", name), "")
-	if err != nil {
-		return
-	}
-	err = logAndRunCmd(c, log,
-		fmt.Sprintf("sudo lxc-attach -n %s -- sed -i \"s/127.0.1.1.*/127.0.1.1   %s/\" /etc/hosts", name, name),
-		"")
-	if err != nil {
-		return
-	}
-	err = logAndRunCmd(c, log, fmt.Sprintf("sudo lxc-attach -n %s -- ping -c1 8.8.8.8", name), "")
-	return
-}
-
-func destroyContainer(c *ssh.Client, log io.Writer, name string, failOnError bool) error {
-	var err error
-	err = logAndRunCmd(c, log, fmt.Sprintf("sudo lxc-stop -n %s", name), "")
-	if err != nil && failOnError {
-		return err
-	}
-	err = logAndRunCmd(c, log, fmt.Sprintf("sudo lxc-destroy -n %s", name), "")
-	if err != nil && failOnError {
-		return err
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("unable to destroy %d of %d nodes: %s", len(errs), len(nodes), strings.Join(errs, "; "))
 	}
 	return nil
 }
-
-func addAuthorizedKey(c *ssh.Client, log io.Writer, name, pubKey string) (err error) {
-	//TODO make the user configurable
-	cmd := fmt.Sprintf("sudo lxc-attach -n %s -- tee -a /home/sdn/.ssh/authorized_keys", name)
-	err = logAndRunCmd(c, log, cmd, pubKey)
-	return
-}
-
-func addKeyPair(c *ssh.Client, log io.Writer, name, privKey, pubKey string) (err error) {
-	var cmd string
-	//TODO make the user configurable
-	cmd = fmt.Sprintf("sudo lxc-attach -n %s -- tee /home/sdn/.ssh/id_rsa", name)
-	err = logAndRunCmd(c, log, cmd, privKey)
-	if err != nil {
-		return
-	}
-	cmd = fmt.Sprintf("sudo lxc-attach -n %s -- chmod 400 /home/sdn/.ssh/id_rsa", name)
-	err = logAndRunCmd(c, log, cmd, "")
-	if err != nil {
-		return
-	}
-	cmd = fmt.Sprintf("sudo lxc-attach -n %s -- chown sdn:sdn /home/sdn/.ssh/id_rsa", name)
-	err = logAndRunCmd(c, log, cmd, "")
-	if err != nil {
-		return
-	}
-	cmd = fmt.Sprintf("sudo lxc-attach -n %s -- tee /home/sdn/.ssh/id_rsa.pub", name)
-	err = logAndRunCmd(c, log, cmd, pubKey)
-	if err != nil {
-		return
-	}
-	cmd = fmt.Sprintf("sudo lxc-attach -n %s -- chmod 400 /home/sdn/.ssh/id_rsa.pub", name)
-	err = logAndRunCmd(c, log, cmd, "")
-	if err != nil {
-		return
-	}
-	cmd = fmt.Sprintf("sudo lxc-attach -n %s -- chown sdn:sdn /home/sdn/.ssh/id_rsa.pub", name)
-	err = logAndRunCmd(c, log, cmd, "")
-	return
-}
-
-func acceptHostKey(c *ssh.Client, log io.Writer, name, remoteIp string) error {
-	//TODO make user dynamic
-	cmd := fmt.Sprintf("sudo lxc-attach -n %s -- sudo -u sdn ssh -n -o StrictHostKeyChecking=no -o PasswordAuthentication=no sdn@%s hostname", name, remoteIp)
-	return logAndRunCmd(c, log, cmd, "")
-}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/opennetworkinglab/onos-warden/agent"
+	"github.com/opennetworkinglab/onos-warden/agent/container"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Commands run on the instance to provision each node of a cluster of size 2
+var provisionTranscripts = map[string][]string{
+	"onos-n": {
+		"sudo lxc-ls -1",
+		"sudo lxc-copy -n test-base -s snap0 -B overlay -N onos-n",
+		`sudo tee -a /var/lib/lxc/onos-n/config < "lxc.network.ipv4 = 10.0.1.100/24\nlxc.network.ipv4.gateway = 10.0.1.1\n"`,
+		"sudo lxc-start -d -n onos-n",
+		"sudo lxc-wait -n onos-n -s RUNNING -t 10",
+		"sudo lxc-attach -n onos-n -- sed -i 's/127.0.1.1.*/127.0.1.1   onos-n/' /etc/hosts",
+		"sudo lxc-attach -n onos-n -- ping -c1 8.8.8.8",
+		`sudo lxc-attach -n onos-n -- tee /home/sdn/.ssh/id_rsa < "PRIVATE"`,
+		"sudo lxc-attach -n onos-n -- chmod 400 /home/sdn/.ssh/id_rsa",
+		"sudo lxc-attach -n onos-n -- chown sdn:sdn /home/sdn/.ssh/id_rsa",
+		`sudo lxc-attach -n onos-n -- tee /home/sdn/.ssh/id_rsa.pub < "PUBLIC"`,
+		"sudo lxc-attach -n onos-n -- chmod 400 /home/sdn/.ssh/id_rsa.pub",
+		"sudo lxc-attach -n onos-n -- chown sdn:sdn /home/sdn/.ssh/id_rsa.pub",
+		`sudo lxc-attach -n onos-n -- tee -a /home/sdn/.ssh/authorized_keys < "ssh-rsa USER"`,
+		`sudo lxc-attach -n onos-n -- tee -a /home/sdn/.ssh/authorized_keys < "PUBLIC"`,
+		"sudo lxc-attach -n onos-n -- sudo -u sdn ssh -n -o StrictHostKeyChecking=no -o PasswordAuthentication=no sdn@10.0.1.100 hostname",
+	},
+	"onos-1": {
+		"sudo lxc-ls -1",
+		"sudo lxc-copy -n ctrl-base -s snap0 -B overlay -N onos-1",
+		`sudo tee -a /var/lib/lxc/onos-1/config < "lxc.network.ipv4 = 10.0.1.101/24\nlxc.network.ipv4.gateway = 10.0.1.1\n"`,
+		"sudo lxc-start -d -n onos-1",
+		"sudo lxc-wait -n onos-1 -s RUNNING -t 10",
+		"sudo lxc-attach -n onos-1 -- sed -i 's/127.0.1.1.*/127.0.1.1   onos-1/' /etc/hosts",
+		"sudo lxc-attach -n onos-1 -- ping -c1 8.8.8.8",
+		`sudo lxc-attach -n onos-1 -- tee /home/sdn/.ssh/id_rsa < "PRIVATE"`,
+		"sudo lxc-attach -n onos-1 -- chmod 400 /home/sdn/.ssh/id_rsa",
+		"sudo lxc-attach -n onos-1 -- chown sdn:sdn /home/sdn/.ssh/id_rsa",
+		`sudo lxc-attach -n onos-1 -- tee /home/sdn/.ssh/id_rsa.pub < "PUBLIC"`,
+		"sudo lxc-attach -n onos-1 -- chmod 400 /home/sdn/.ssh/id_rsa.pub",
+		"sudo lxc-attach -n onos-1 -- chown sdn:sdn /home/sdn/.ssh/id_rsa.pub",
+		`sudo lxc-attach -n onos-1 -- tee -a /home/sdn/.ssh/authorized_keys < "ssh-rsa USER"`,
+		`sudo lxc-attach -n onos-1 -- tee -a /home/sdn/.ssh/authorized_keys < "PUBLIC"`,
+		"sudo lxc-attach -n onos-n -- sudo -u sdn ssh -n -o StrictHostKeyChecking=no -o PasswordAuthentication=no sdn@10.0.1.101 hostname",
+	},
+	"onos-2": {
+		"sudo lxc-ls -1",
+		"sudo lxc-copy -n ctrl-base -s snap0 -B overlay -N onos-2",
+		`sudo tee -a /var/lib/lxc/onos-2/config < "lxc.network.ipv4 = 10.0.1.102/24\nlxc.network.ipv4.gateway = 10.0.1.1\n"`,
+		"sudo lxc-start -d -n onos-2",
+		"sudo lxc-wait -n onos-2 -s RUNNING -t 10",
+		"sudo lxc-attach -n onos-2 -- sed -i 's/127.0.1.1.*/127.0.1.1   onos-2/' /etc/hosts",
+		"sudo lxc-attach -n onos-2 -- ping -c1 8.8.8.8",
+		`sudo lxc-attach -n onos-2 -- tee /home/sdn/.ssh/id_rsa < "PRIVATE"`,
+		"sudo lxc-attach -n onos-2 -- chmod 400 /home/sdn/.ssh/id_rsa",
+		"sudo lxc-attach -n onos-2 -- chown sdn:sdn /home/sdn/.ssh/id_rsa",
+		`sudo lxc-attach -n onos-2 -- tee /home/sdn/.ssh/id_rsa.pub < "PUBLIC"`,
+		"sudo lxc-attach -n onos-2 -- chmod 400 /home/sdn/.ssh/id_rsa.pub",
+		"sudo lxc-attach -n onos-2 -- chown sdn:sdn /home/sdn/.ssh/id_rsa.pub",
+		`sudo lxc-attach -n onos-2 -- tee -a /home/sdn/.ssh/authorized_keys < "ssh-rsa USER"`,
+		`sudo lxc-attach -n onos-2 -- tee -a /home/sdn/.ssh/authorized_keys < "PUBLIC"`,
+		"sudo lxc-attach -n onos-n -- sudo -u sdn ssh -n -o StrictHostKeyChecking=no -o PasswordAuthentication=no sdn@10.0.1.102 hostname",
+	},
+}
+
+// Commands run on the instance to destroy each node of a cluster of size 2
+var destroyTranscripts = map[string][]string{
+	"onos-n": {"sudo lxc-ls -1", "sudo lxc-stop -n onos-n", "sudo lxc-destroy -n onos-n"},
+	"onos-1": {"sudo lxc-ls -1", "sudo lxc-stop -n onos-1", "sudo lxc-destroy -n onos-1"},
+	"onos-2": {"sudo lxc-ls -1", "sudo lxc-stop -n onos-2", "sudo lxc-destroy -n onos-2"},
+}
+
+// EC2 service that keeps the tags of instances, which are all running, unless describing them fails
+type fakeEC2 struct {
+	ec2iface.EC2API
+	mux         sync.Mutex
+	tags        map[string][]*ec2.Tag
+	describeErr error
+}
+
+func (f *fakeEC2) CreateTags(in *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for _, id := range in.Resources {
+		f.tags[*id] = in.Tags
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.describeErr != nil {
+		return nil, f.describeErr
+	}
+	var insts []*ec2.Instance
+	for _, id := range in.InstanceIds {
+		insts = append(insts, &ec2.Instance{
+			InstanceId:      id,
+			InstanceType:    aws.String(InstanceType),
+			LaunchTime:      aws.Time(time.Now()),
+			PublicIpAddress: aws.String("54.0.0.1"),
+			State:           &ec2.InstanceState{Code: aws.Int64(16)},
+			Tags:            f.tags[*id],
+		})
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: insts}}}, nil
+}
+
+// Records the advertisements published by the worker and the failures it reports
+type recordingClient struct {
+	agent.WardenClient
+	mux        sync.Mutex
+	ads        []warden.ClusterAdvertisement
+	failures   []string
+	rejections []string
+}
+
+func (r *recordingClient) PublishUpdate(ad *warden.ClusterAdvertisement) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.ads = append(r.ads, *ad)
+	return nil
+}
+
+func (r *recordingClient) Acknowledge(req *warden.ClusterRequest, phase warden.RequestAck_Phase, msg string) error {
+	return nil
+}
+
+func (r *recordingClient) ReportProgress(req *warden.ClusterRequest, step, steps uint32, msg string) error {
+	return nil
+}
+
+func (r *recordingClient) Reject(req *warden.ClusterRequest, code codes.Code, msg string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.rejections = append(r.rejections, fmt.Sprintf("%v: %s", code, msg))
+	return nil
+}
+
+func (r *recordingClient) ReportFailure(req *warden.ClusterRequest, code codes.Code, msg string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.failures = append(r.failures, fmt.Sprintf("%v: %s", code, msg))
+	return nil
+}
+
+// Returns a client whose instance commands are recorded instead of being run over SSH
+func newTestClient(t *testing.T, rec *container.Recorder) *ec2Client {
+	keyPair := generateKeyPair
+	generateKeyPair = func() (string, string, error) {
+		return "PRIVATE", "PUBLIC", nil
+	}
+	t.Cleanup(func() { generateKeyPair = keyPair })
+
+	c := &ec2Client{
+		svc:        &fakeEC2{tags: make(map[string][]*ec2.Tag)},
+		clusters:   make(map[string]cluster),
+		requests:   make(map[string]string),
+		spotPrices: make(map[string]float64),
+		costs:      new(costLog),
+	}
+	c.Bind(&recordingClient{})
+	c.connect = func(cl *cluster) (nodeHosts, func(), error) {
+		return func(name string) (*container.Host, error) {
+			return &container.Host{Runner: rec.Node(name)}, nil
+		}, func() {}, nil
+	}
+	return c
+}
+
+func testCluster() *cluster {
+	return &cluster{
+		ClusterAdvertisement: warden.ClusterAdvertisement{
+			ClusterId:   "cell-1",
+			ClusterType: ClusterType,
+			HeadNodeIP:  "54.0.0.1",
+			RequestId:   "r1",
+			State:       warden.ClusterAdvertisement_RESERVED,
+			ReservationInfo: &warden.ClusterAdvertisement_ReservationInfo{
+				UserName:             "tom",
+				Duration:             60,
+				ReservationStartTime: 1488794400,
+			},
+		},
+		Size:         2,
+		InstanceId:   "i-1",
+		InstanceType: InstanceType,
+	}
+}
+
+func checkTranscript(t *testing.T, rec *container.Recorder, node string, expected []string) {
+	t.Helper()
+	if cmds := rec.Transcript(node); strings.Join(cmds, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected commands for %s:\n%s\ngot:\n%s", node, strings.Join(expected, "\n"), strings.Join(cmds, "\n"))
+	}
+}
+
+func TestProvisionCluster(t *testing.T) {
+	rec := &container.Recorder{}
+	c := newTestClient(t, rec)
+	noProgress := func(step, steps uint32, msg string) {}
+	if err := c.provisionCluster(testCluster(), "ssh-rsa USER", noProgress); err != nil {
+		t.Fatal(err)
+	}
+	for node, expected := range provisionTranscripts {
+		checkTranscript(t, rec, node, expected)
+	}
+	if cl := c.clusters["cell-1"]; cl.State != warden.ClusterAdvertisement_READY || cl.RequestId != "r1" {
+		t.Errorf("Expected cluster to be ready, got %v", cl.ClusterAdvertisement)
+	}
+}
+
+// Fails the given step of the node; the containers of all nodes exist once they have been created
+func failStep(node string, step int) func(string, int, string) (string, error) {
+	return func(n string, i int, cmd string) (string, error) {
+		switch {
+		case n == node && i == step:
+			return "", errors.New("exit status 1")
+		case cmd == "sudo lxc-ls -1" && i > 0:
+			return "onos-n\nonos-1\nonos-2\n", nil
+		}
+		return "", nil
+	}
+}
+
+func rollbackTranscript(node string) []string {
+	return []string{"sudo lxc-ls -1", "sudo lxc-stop -n " + node, "sudo lxc-destroy -n " + node}
+}
+
+func TestProvisionClusterFailure(t *testing.T) {
+	noProgress := func(step, steps uint32, msg string) {}
+	for _, node := range []string{"onos-n", "onos-1"} {
+		golden := provisionTranscripts[node]
+		for step := range golden {
+			rec := &container.Recorder{Reply: failStep(node, step)}
+			c := newTestClient(t, rec)
+			err := c.provisionCluster(testCluster(), "ssh-rsa USER", noProgress)
+			if err == nil || !strings.Contains(err.Error(), node) {
+				t.Errorf("Expected %s to fail at step %d, got %v", node, step, err)
+			}
+
+			// the node's setup stops at the failed step, and every node created is destroyed
+			checkTranscript(t, rec, node, append(append([]string(nil), golden[:step+1]...), rollbackTranscript(node)...))
+			for other, expected := range provisionTranscripts {
+				switch {
+				case other == node:
+				case node == "onos-n":
+					// the ONOS nodes are not created without the mininet node
+					checkTranscript(t, rec, other, nil)
+				default:
+					checkTranscript(t, rec, other, append(append([]string(nil), expected...), rollbackTranscript(other)...))
+				}
+			}
+			if _, ok := c.clusters["cell-1"]; ok {
+				t.Errorf("Expected the failed cluster not to be updated, got %v", c.clusters["cell-1"].ClusterAdvertisement)
+			}
+		}
+	}
+}
+
+func TestProvisionClusterDescribeFailure(t *testing.T) {
+	rec := &container.Recorder{Reply: failStep("", -1)}
+	c := newTestClient(t, rec)
+	c.svc.(*fakeEC2).describeErr = errors.New("RequestLimitExceeded")
+	err := c.provisionCluster(testCluster(), "ssh-rsa USER", func(step, steps uint32, msg string) {})
+	if err == nil || err.Error() != "RequestLimitExceeded" {
+		t.Errorf("Expected the instance not to be found, got %v", err)
+	}
+	// the containers were all created, and are all destroyed
+	for node, expected := range provisionTranscripts {
+		checkTranscript(t, rec, node, append(append([]string(nil), expected...), rollbackTranscript(node)...))
+	}
+}
+
+func TestProvisionClusterLogFailure(t *testing.T) {
+	rec := &container.Recorder{}
+	c := newTestClient(t, rec)
+	c.connect = func(cl *cluster) (nodeHosts, func(), error) {
+		return func(name string) (*container.Host, error) {
+			if name == "onos-2" {
+				return nil, errors.New("unable to open log")
+			}
+			return &container.Host{Runner: rec.Node(name)}, nil
+		}, func() {}, nil
+	}
+	err := c.provisionCluster(testCluster(), "ssh-rsa USER", func(step, steps uint32, msg string) {})
+	if err == nil || err.Error() != "unable to create 1 of 2 nodes: onos-2: unable to open log" {
+		t.Errorf("Expected onos-2 to fail, got %v", err)
+	}
+	checkTranscript(t, rec, "onos-2", nil)
+}
+
+func TestReserveFailure(t *testing.T) {
+	rec := &container.Recorder{Reply: failStep("onos-2", 4)}
+	c := newTestClient(t, rec)
+	c.costs.path = filepath.Join(t.TempDir(), "ec2-costs.log")
+	rc := c.client.(*recordingClient)
+	avail := testCluster()
+	avail.RequestId, avail.ReservationInfo = "", nil
+	avail.State = warden.ClusterAdvertisement_AVAILABLE
+	c.clusters["cell-1"] = *avail
+
+	c.Handle(&warden.ClusterRequest{
+		ClusterType: ClusterType,
+		Type:        warden.ClusterRequest_RESERVE,
+		RequestId:   "r1",
+		Duration:    60,
+		Spec:        &warden.ClusterRequest_Spec{ControllerNodes: 2, UserName: "tom", UserKey: "ssh-rsa USER"},
+	})
+
+	if len(rc.failures) != 1 || !strings.Contains(rc.failures[0], "onos-2: lxc-wait") {
+		t.Errorf("Expected the failure of onos-2 to be reported, got %v", rc.failures)
+	}
+	for _, ad := range rc.ads {
+		if ad.State == warden.ClusterAdvertisement_READY {
+			t.Errorf("Expected the broken cluster never to be advertised as ready, got %v", ad)
+		}
+	}
+	last := rc.ads[len(rc.ads)-1]
+	if last.State != warden.ClusterAdvertisement_AVAILABLE || last.RequestId != "" || len(c.requests) != 0 {
+		t.Errorf("Expected the cluster to be available again, got %v", last)
+	}
+	// the user is not charged for a cluster that was never ready
+	if _, err := os.Stat(c.costs.path); !os.IsNotExist(err) {
+		t.Errorf("Expected no cost to be recorded, got %v", err)
+	}
+}
+
+func TestReserveInvalidSpec(t *testing.T) {
+	c := newTestClient(t, &container.Recorder{})
+	rc := c.client.(*recordingClient)
+	avail := testCluster()
+	avail.RequestId, avail.ReservationInfo, avail.InstanceId = "", nil, ""
+	avail.State = warden.ClusterAdvertisement_AVAILABLE
+	c.clusters["cell-1"] = *avail
+
+	for _, spec := range []*warden.ClusterRequest_Spec{nil, {ControllerNodes: MaxControllerNodes + 1, UserName: "tom"}} {
+		c.Handle(&warden.ClusterRequest{ClusterType: ClusterType, Type: warden.ClusterRequest_RESERVE, RequestId: "r1", Spec: spec})
+	}
+	if len(rc.rejections) != 2 || !strings.HasPrefix(rc.rejections[0], codes.InvalidArgument.String()) ||
+		!strings.HasPrefix(rc.rejections[1], codes.InvalidArgument.String()) {
+		t.Errorf("Expected both reservations to be invalid, got %v", rc.rejections)
+	}
+	// no spot request was made for the placeholder cluster, nor was it reserved
+	if len(rc.ads) != 0 || c.clusters["cell-1"].State != warden.ClusterAdvertisement_AVAILABLE {
+		t.Errorf("Expected the cluster to be left alone, got %v", rc.ads)
+	}
+}
+
+func TestDestroyCluster(t *testing.T) {
+	rec := &container.Recorder{Reply: func(node string, i int, cmd string) (string, error) {
+		switch {
+		case cmd == "sudo lxc-ls -1":
+			return "test-base\nctrl-base\nonos-n\nonos-1\nonos-2\n", nil
+		case node == "onos-1" && strings.Contains(cmd, "lxc-stop"):
+			// a container that is not running cannot be stopped, but is still destroyed
+			return "", errors.New("exit status 1")
+		}
+		return "", nil
+	}}
+	c := newTestClient(t, rec)
+	if err := c.destroyCluster(testCluster()); err != nil {
+		t.Fatal(err)
+	}
+	for node, expected := range destroyTranscripts {
+		checkTranscript(t, rec, node, expected)
+	}
+
+	// containers that do not exist are left alone
+	rec = &container.Recorder{}
+	c = newTestClient(t, rec)
+	if err := c.destroyCluster(testCluster()); err != nil {
+		t.Fatal(err)
+	}
+	for node := range destroyTranscripts {
+		checkTranscript(t, rec, node, []string{"sudo lxc-ls -1"})
+	}
+}
+
+func TestNodeLogAppends(t *testing.T) {
+	cl := testCluster()
+	cl.ClusterId = fmt.Sprintf("log-test-%d", os.Getpid())
+	defer os.RemoveAll(fmt.Sprintf("/tmp/%s-%s", cl.ClusterId, cl.ClusterType))
+
+	// the rollback of a node reopens its log, which must keep the output of the failed step
+	for _, line := range []string{"create failed\n", "destroyed\n"} {
+		f, err := nodeLog(cl, "onos-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(line)
+		f.Close()
+	}
+	b, err := ioutil.ReadFile(fmt.Sprintf("/tmp/%s-%s/onos-1.log", cl.ClusterId, cl.ClusterType))
+	if err != nil || string(b) != "create failed\ndestroyed\n" {
+		t.Errorf("Expected both steps to be logged, got %q (%v)", b, err)
+	}
+}
@@ -12,7 +12,7 @@ import (
 	"time"
 )
 
-func (c *ec2Client) makeSpotRequest(cl *cluster) error {
+func (c *ec2Client) makeSpotRequest(cl *cluster, progress progressFunc) error {
 	if cl.InstanceId != "" {
 		return errors.New("Instance already exists for this cluster")
 	}
@@ -47,6 +47,7 @@ func (c *ec2Client) makeSpotRequest(cl *cluster) error {
 	for _, r := range out.SpotInstanceRequests {
 		ids = append(ids, r.SpotInstanceRequestId)
 	}
+	progress(0, 0, "spot request submitted")
 	fmt.Print("Wait for reservation...")
 	for { // Wait for reservation to be fulfilled
 		time.Sleep(startupPollingInterval)
@@ -69,6 +70,7 @@ func (c *ec2Client) makeSpotRequest(cl *cluster) error {
 		}
 		fmt.Print(".")
 	}
+	progress(0, 0, "spot request fulfilled by instance "+cl.InstanceId)
 	//TODO: OR consider...
 	//c.svc.WaitUntilSpotInstanceRequestFulfilled(&ec2.DescribeSpotInstanceRequestsInput{
 	//	SpotInstanceRequestIds: ids,
@@ -81,6 +83,7 @@ func (c *ec2Client) makeSpotRequest(cl *cluster) error {
 			// Copy the node IP over from the newly created instance
 			cl.HeadNodeIP = targetCl.HeadNodeIP
 			fmt.Println(cl)
+			progress(0, 0, fmt.Sprintf("instance %s running at %s", cl.InstanceId, cl.HeadNodeIP))
 			break
 		}
 		time.Sleep(startupPollingInterval)
@@ -141,6 +144,7 @@ func (c *ec2Client) terminateInstance(cl cluster) {
 	}
 
 	fmt.Printf("Terminating %s (%s)\n", cl.ClusterId, cl.InstanceId)
+	c.recordInstanceCost(&cl)
 	c.mux.Lock()
 	defer c.mux.Unlock()
 	c.addOrUpdate(emptyCluster(cl.ClusterId))
@@ -177,9 +181,16 @@ func (c *ec2Client) updateInstances() error {
 		fmt.Println("Failed to get instances", err)
 		return err
 	}
+	prices, err := c.fetchSpotPrices()
+	if err != nil {
+		fmt.Println("Failed to get spot prices", err)
+	}
 
 	c.mux.Lock()
 	defer c.mux.Unlock()
+	for zone, price := range prices {
+		c.spotPrices[zone] = price
+	}
 
 	update := make(map[string]bool)
 	for k := range c.clusters {
@@ -192,6 +203,7 @@ func (c *ec2Client) updateInstances() error {
 			cl, err := clusterFromInstance(inst)
 			update[cl.ClusterId] = true
 			if err == nil {
+				c.priceCluster(&cl)
 				if shouldShutdown(&cl) {
 					go c.terminateInstance(cl)
 				} else {
@@ -204,6 +216,10 @@ func (c *ec2Client) updateInstances() error {
 	// Remove clusters that are missing from EC2
 	for k, updated := range update {
 		if !updated {
+			// the instance was terminated without us, e.g. by a spot interruption
+			old := c.clusters[k]
+			c.recordReservationCost(&old)
+			c.recordInstanceCost(&old)
 			c.addOrUpdate(emptyCluster(k))
 		}
 	}
@@ -215,11 +231,15 @@ func clusterFromInstance(inst *ec2.Instance) (c cluster, err error) {
 		ClusterAdvertisement: warden.ClusterAdvertisement{
 			ClusterType:     ClusterType,
 			ReservationInfo: &warden.ClusterAdvertisement_ReservationInfo{},
+			Capacity:        clusterCapacity(),
 		},
 		InstanceId:   *inst.InstanceId,
 		InstanceType: *inst.InstanceType,
 		LaunchTime:   *inst.LaunchTime,
 	}
+	if inst.Placement != nil && inst.Placement.AvailabilityZone != nil {
+		c.Zone = *inst.Placement.AvailabilityZone
+	}
 	if inst.PublicIpAddress != nil {
 		c.HeadNodeIP = *inst.PublicIpAddress
 	}
@@ -8,8 +8,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/opennetworkinglab/onos-warden/agent"
 	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc/codes"
 	"net"
 	"os"
 	"reflect"
@@ -24,7 +26,9 @@ type cluster struct {
 	InstanceType    string
 	InstanceStarted bool
 	LaunchTime      time.Time
-	provisionMux	sync.Mutex
+	Zone            string  // availability zone of the instance
+	SpotPrice       float64 // US dollars per hour
+	provisionMux    sync.Mutex
 }
 
 const (
@@ -34,7 +38,10 @@ const (
 	InstanceImageId               = "ami-3fcb935f"
 	InstanceType                  = "m3.xlarge"
 	KeyName                       = "onos-warden"
-	MaxPrice                      = "1" // $1/hr, TODO make this dynamic
+	MaxPrice                      = "1"   // $1/hr, TODO make this dynamic
+	InstanceCpus                  = 4     // vCPUs of InstanceType
+	InstanceMemoryMb              = 15360 // memory of InstanceType
+	MaxControllerNodes            = 7     // ONOS containers that fit on InstanceType
 	updatePollingInterval         = 2 * time.Minute
 	startupPollingInterval        = 2 * time.Second
 )
@@ -42,7 +49,7 @@ const (
 var IpBase = binary.BigEndian.Uint32(net.ParseIP("10.0.1.100")[12:16])
 
 type ec2Client struct {
-	svc        *ec2.EC2
+	svc        ec2iface.EC2API
 	client     agent.WardenClient
 	clusters   map[string]cluster
 	requests   map[string]string
@@ -50,6 +57,12 @@ type ec2Client struct {
 	mux        sync.Mutex
 	ec2User    string
 	ec2KeyFile string
+	// current spot price of InstanceType by availability zone, and the log of what clusters cost
+	spotPrices map[string]float64
+	costs      *costLog
+	// connects to the cluster's instance, on which the containers of its nodes run; the returned
+	// function closes the connection and the logs of the nodes
+	connect func(cl *cluster) (nodeHosts, func(), error)
 }
 
 func NewEC2Client(region string, limit int) (*ec2Client, error) {
@@ -64,6 +77,9 @@ func NewEC2Client(region string, limit int) (*ec2Client, error) {
 	c.clusters = make(map[string]cluster)
 	c.requests = make(map[string]string)
 	c.limit = limit
+	c.spotPrices = make(map[string]float64)
+	c.costs = new(costLog)
+	c.connect = c.connectSSH
 
 	return &c, err
 }
@@ -93,6 +109,13 @@ func (c *ec2Client) Start() {
 	}()
 }
 
+func (c *ec2Client) Registration() *warden.AgentRegistration {
+	return &warden.AgentRegistration{
+		ClusterType:  ClusterType,
+		Capabilities: []string{"reserve", "extend", "return", "ack"},
+	}
+}
+
 func (c *ec2Client) Teardown() {
 	//TODO
 	fmt.Println("teardown...")
@@ -100,43 +123,107 @@ func (c *ec2Client) Teardown() {
 
 func (c *ec2Client) Handle(req *warden.ClusterRequest) {
 	if req.ClusterType != "" && req.ClusterType != ClusterType {
-		fmt.Printf("Requested cluster type %s is not %s", req.ClusterType, ClusterType)
+		c.reject(req, codes.InvalidArgument, fmt.Sprintf("Requested cluster type %s is not %s", req.ClusterType, ClusterType), nil)
 		return
 	}
 
 	switch req.Type {
 	case warden.ClusterRequest_RESERVE:
-		cl, err := c.reserveCluster(req)
+		if err := checkSpec(req); err != nil {
+			c.reject(req, codes.InvalidArgument, "Invalid reservation", err)
+			return
+		}
+		progress := c.progress(req)
+		cl, err := c.reserveCluster(req, progress)
 		if err != nil {
-			fmt.Println("Unable reserve cluster for request", req, err)
+			c.reject(req, codes.Unavailable, "Unable reserve cluster", err)
 			return
 		}
-		err = c.provisionCluster(cl, req.Spec.UserKey)
+		c.ack(req, warden.RequestAck_ACCEPTED, "reserved cluster "+cl.ClusterId)
+		err = c.provisionCluster(cl, req.Spec.UserKey, progress)
 		if err != nil {
-			fmt.Println("Unable to provision cluster for request", req, err)
+			c.fail(req, codes.Internal, "Unable to provision cluster", err)
+			c.releaseCluster(cl)
 			return
 		}
+		c.ack(req, warden.RequestAck_COMPLETED, "provisioned cluster "+cl.ClusterId)
 
 	case warden.ClusterRequest_EXTEND:
 		_, err := c.extendCluster(req)
 		if err != nil {
-			fmt.Println("Unable process extension", req, err)
+			c.reject(req, codes.FailedPrecondition, "Unable process extension", err)
 			return
 		}
+		c.ack(req, warden.RequestAck_COMPLETED, "extended reservation")
 	case warden.ClusterRequest_RETURN:
 		fmt.Println("Got return", req)
 		cl, err := c.returnCluster(req)
 		if err != nil {
-			fmt.Println("Unable process return", req, err)
+			c.reject(req, codes.FailedPrecondition, "Unable process return", err)
 			return
 		}
+		c.ack(req, warden.RequestAck_ACCEPTED, "destroying cluster "+cl.ClusterId)
 		err = c.destroyCluster(cl)
 		if err != nil {
-			fmt.Println("Unable destroy cluster", req, err)
+			c.fail(req, codes.Internal, "Unable destroy cluster", err)
 			return
 		}
+		c.ack(req, warden.RequestAck_COMPLETED, "destroyed cluster "+cl.ClusterId)
 	default:
-		fmt.Printf("Unsupported request: %+v\n", req)
+		c.reject(req, codes.Unimplemented, fmt.Sprintf("Unsupported request type %v", req.Type), nil)
+	}
+}
+
+// Returns an error if no cluster could satisfy the reservation
+func checkSpec(req *warden.ClusterRequest) error {
+	if req.Spec == nil {
+		return errors.New("reservation has no spec")
+	}
+	if req.Spec.ControllerNodes > MaxControllerNodes {
+		return fmt.Errorf("cluster cannot fit %d controller nodes", req.Spec.ControllerNodes)
+	}
+	return nil
+}
+
+// Tells the warden how far the request has got
+func (c *ec2Client) ack(req *warden.ClusterRequest, phase warden.RequestAck_Phase, msg string) {
+	if err := c.client.Acknowledge(req, phase, msg); err != nil {
+		fmt.Println("Unable to acknowledge request", req.RequestId, err)
+	}
+}
+
+// Reports a step of a request; steps is 0 if the total is unknown
+type progressFunc func(step, steps uint32, msg string)
+
+// Returns a function that logs the progress of the request and reports it to the warden
+func (c *ec2Client) progress(req *warden.ClusterRequest) progressFunc {
+	return func(step, steps uint32, msg string) {
+		fmt.Println(msg)
+		if err := c.client.ReportProgress(req, step, steps, msg); err != nil {
+			fmt.Println("Unable to report progress of request", req.RequestId, err)
+		}
+	}
+}
+
+// Logs the refused request and reports it to the warden
+func (c *ec2Client) reject(req *warden.ClusterRequest, code codes.Code, msg string, err error) {
+	if err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, err)
+	}
+	fmt.Println(msg, req)
+	if rerr := c.client.Reject(req, code, msg); rerr != nil {
+		fmt.Println("Unable to report rejection of request", req.RequestId, rerr)
+	}
+}
+
+// Logs the failure of the accepted request and reports it to the warden
+func (c *ec2Client) fail(req *warden.ClusterRequest, code codes.Code, msg string, err error) {
+	if err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, err)
+	}
+	fmt.Println(msg, req)
+	if rerr := c.client.ReportFailure(req, code, msg); rerr != nil {
+		fmt.Println("Unable to report failure of request", req.RequestId, rerr)
 	}
 }
 
@@ -159,7 +246,7 @@ func (c *ec2Client) addOrUpdate(cl cluster) {
 
 }
 
-func (c *ec2Client) reserveCluster(req *warden.ClusterRequest) (cl *cluster, err error) {
+func (c *ec2Client) reserveCluster(req *warden.ClusterRequest, progress progressFunc) (cl *cluster, err error) {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
@@ -206,7 +293,7 @@ func (c *ec2Client) reserveCluster(req *warden.ClusterRequest) (cl *cluster, err
 		return nil, errors.New("no available clusters")
 	} else if cl == nil {
 		cl = placeholder
-		err := c.makeSpotRequest(cl)
+		err := c.makeSpotRequest(cl, progress)
 		if err != nil {
 			return nil, err
 		}
@@ -289,20 +376,48 @@ func (c *ec2Client) returnCluster(req *warden.ClusterRequest) (*cluster, error)
 		return nil, errors.New("cluster not found")
 	}
 
-	cl := oldCl
+	c.recordReservationCost(&oldCl)
+	c.clearReservation(oldCl)
+	return &oldCl, nil
+}
+
+// Releases the reservation of the cluster, whose provisioning failed, and advertises the cluster
+// as available again, unless it has since been returned or reserved again; the user is not
+// charged for a reservation that was never ready
+func (c *ec2Client) releaseCluster(cl *cluster) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	cur, ok := c.clusters[cl.ClusterId]
+	if !ok || cur.RequestId != cl.RequestId {
+		return
+	}
+	c.clearReservation(cur)
+}
+
+// Ends the reservation of the cluster and advertises it as available
+// You must hold c.mux before calling this method
+func (c *ec2Client) clearReservation(cl cluster) {
 	cl.RequestId = ""
 	cl.State = warden.ClusterAdvertisement_AVAILABLE
 	cl.ReservationInfo = nil
 	c.tagInstance(cl.InstanceId, &cl)
 	c.addOrUpdate(cl)
-	return &oldCl, nil
 }
 
 func main() {
 	c, cErr := NewEC2Client(DefaultAwsRegion, 3)
 	flag.StringVar(&c.ec2KeyFile, "keyFile", "", "Private key file used to ssh into newly created EC2 instances")
 	flag.StringVar(&c.ec2User, "user", "ubuntu", "Username used to ssh into newly created EC2 instances")
+	flag.StringVar(&c.costs.path, "costLog", "ec2-costs.log", "File to which the cost of each reservation and instance is appended; empty to disable")
 	flag.Parse()
+	if flag.Arg(0) == "report" {
+		// Print the costs by week and by user, rather than run the agent
+		if err := printCostReport(c.costs.path, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to report costs:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if c.ec2KeyFile == "" {
 		flag.Usage()
 		os.Exit(1)
@@ -325,10 +440,20 @@ func emptyCluster(id string) cluster {
 			ClusterType: ClusterType,
 			State:       warden.ClusterAdvertisement_AVAILABLE,
 			ClusterId:   id,
+			Capacity:    clusterCapacity(),
 		},
 	}
 }
 
+func clusterCapacity() *warden.ClusterAdvertisement_Capacity {
+	return &warden.ClusterAdvertisement_Capacity{
+		MaxControllerNodes: MaxControllerNodes,
+		Cpus:               InstanceCpus,
+		MemoryMb:           InstanceMemoryMb,
+		Features:           []string{"mininet"},
+	}
+}
+
 func shouldShutdown(cl *cluster) bool {
 	if !cl.InstanceStarted || cl.State != warden.ClusterAdvertisement_AVAILABLE {
 		return false
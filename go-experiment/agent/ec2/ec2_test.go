@@ -57,3 +57,46 @@ func TestShouldShutdown(t *testing.T) {
 		}(i))
 	}
 }
+
+func TestEstimateCost(t *testing.T) {
+	start := time.Date(2017, 3, 6, 10, 0, 0, 0, time.UTC)
+	if cost := estimateCost(0.25, start, start.Add(90*time.Minute)); cost != 0.38 {
+		t.Errorf("Expected 0.38, got %v", cost)
+	}
+	if cost := estimateCost(0.25, start, start.Add(-time.Minute)); cost != 0 {
+		t.Errorf("Expected no cost before the start, got %v", cost)
+	}
+	if cost := estimateCost(0, start, start.Add(time.Hour)); cost != 0 {
+		t.Errorf("Expected no cost without a price, got %v", cost)
+	}
+}
+
+func TestAggregateCosts(t *testing.T) {
+	// Monday of ISO week 10 of 2017
+	monday := time.Date(2017, 3, 6, 10, 0, 0, 0, time.UTC)
+	rec := func(kind, user string, start time.Time, hours int, cost float64) costRecord {
+		return costRecord{Kind: kind, UserName: user, Start: start.Unix(),
+			End: start.Add(time.Duration(hours) * time.Hour).Unix(), Cost: cost}
+	}
+	totals := aggregateCosts([]costRecord{
+		rec(costReservation, "tom", monday, 2, 0.5),
+		rec(costReservation, "tom", monday.Add(24*time.Hour), 1, 0.25),
+		rec(costReservation, "ann", monday, 4, 1),
+		rec(costReservation, "tom", monday.Add(7*24*time.Hour), 1, 0.25),
+		rec(costInstance, "", monday, 8, 2),
+	})
+	expected := []costTotal{
+		{"2017-W10", "*", 1, 8, 2},
+		{"2017-W10", "ann", 1, 4, 1},
+		{"2017-W10", "tom", 2, 3, 0.75},
+		{"2017-W11", "tom", 1, 1, 0.25},
+	}
+	if len(totals) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, totals)
+	}
+	for i := range expected {
+		if totals[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], totals[i])
+		}
+	}
+}
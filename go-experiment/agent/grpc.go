@@ -2,13 +2,16 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/opennetworkinglab/onos-warden/warden"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/grpclog"
 	"io"
+	"sync"
 	"time"
-	"fmt"
 )
 
 type Handler interface {
@@ -17,6 +20,16 @@ type Handler interface {
 
 type WardenClient interface {
 	PublishUpdate(ad *warden.ClusterAdvertisement) error
+	// Tells the warden that the cluster is no longer hosted by the agent, so that it is removed
+	Withdraw(ad *warden.ClusterAdvertisement) error
+	// Tells the warden that the request was accepted, is progressing or was completed
+	Acknowledge(req *warden.ClusterRequest, phase warden.RequestAck_Phase, msg string) error
+	// Tells the warden that a step of the request is done; steps is 0 if the total is unknown
+	ReportProgress(req *warden.ClusterRequest, step, steps uint32, msg string) error
+	// Tells the warden that the request was refused without acting on it, and why
+	Reject(req *warden.ClusterRequest, code codes.Code, msg string) error
+	// Tells the warden that the accepted request could not be carried out, and why
+	ReportFailure(req *warden.ClusterRequest, code codes.Code, msg string) error
 	Teardown()
 }
 
@@ -25,13 +38,24 @@ type wardenClient struct {
 	stream warden.ClusterAgentService_AgentClustersClient
 	alive  bool
 	pub    chan *warden.ClusterAdvertisement
+	reg    *warden.AgentRegistration
+
+	// guards the stream for sending and the published advertisements
+	mux sync.Mutex
+	// last advertisement published for each cluster; these are re-sent when reconnecting
+	ads map[string]*warden.ClusterAdvertisement
+	// outcomes of requests that could not be sent; these are re-sent, after the advertisements, when reconnecting
+	unsent []*warden.RequestAck
 }
 
-func NewWardenClient(target string, handler Handler, creds credentials.TransportCredentials) (*wardenClient, error) {
+func NewWardenClient(target string, reg *warden.AgentRegistration, handler Handler, creds credentials.TransportCredentials) (*wardenClient, error) {
 	var wc wardenClient
 	var err error
 	var opts grpc.DialOption
 
+	wc.reg = reg
+	wc.ads = make(map[string]*warden.ClusterAdvertisement)
+
 	if creds == nil {
 		opts = grpc.WithInsecure()
 	} else {
@@ -51,6 +75,7 @@ func NewWardenClient(target string, handler Handler, creds credentials.Transport
 			for i := 0; ; i++ {
 				err = wc.connect(target, opts)
 				if err == nil {
+					wc.republish()
 					break
 				}
 				fmt.Println("Connect error error; retrying...", err)
@@ -63,6 +88,8 @@ func NewWardenClient(target string, handler Handler, creds credentials.Transport
 }
 
 func (c *wardenClient) connect(target string, opts grpc.DialOption) (err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	c.conn, err = grpc.Dial(target, opts)
 	if err != nil {
 		grpclog.Printf("fail to dial: %v", err)
@@ -75,9 +102,34 @@ func (c *wardenClient) connect(target string, opts grpc.DialOption) (err error)
 		c.conn.Close()
 		return
 	}
+	// the server expects the registration before any advertisement
+	err = c.stream.Send(&warden.AgentMessage{Registration: c.reg})
+	if err != nil {
+		grpclog.Printf("failed to register: %v", err)
+		c.conn.Close()
+		return
+	}
 	return nil
 }
 
+// Re-sends the last advertisement of every cluster, so that the server recovers them after a reconnect,
+// followed by the outcomes of requests that could not be sent before
+func (c *wardenClient) republish() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, ad := range c.ads {
+		err := c.send(&warden.AgentMessage{Advertisement: ad})
+		if err != nil {
+			grpclog.Printf("Failed to republish %s: %v", ad.ClusterId, err)
+		}
+	}
+	unsent := c.unsent
+	c.unsent = nil
+	for _, ack := range unsent {
+		c.sendAck(ack)
+	}
+}
+
 func (c *wardenClient) receive(handler Handler) error {
 	for {
 		in, err := c.stream.Recv()
@@ -100,10 +152,84 @@ func (c *wardenClient) receive(handler Handler) error {
 }
 
 func (c *wardenClient) PublishUpdate(ad *warden.ClusterAdvertisement) (err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.ads[ad.ClusterType+"/"+ad.ClusterId] = ad
+	return c.send(&warden.AgentMessage{Advertisement: ad})
+}
+
+func (c *wardenClient) Withdraw(ad *warden.ClusterAdvertisement) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.ads, ad.ClusterType+"/"+ad.ClusterId)
+	w := *ad
+	w.State = warden.ClusterAdvertisement_UNAVAILABLE
+	w.Event = &warden.ClusterAdvertisement_Event{
+		Type:   warden.ClusterAdvertisement_Event_WITHDRAWN,
+		Reason: warden.ClusterAdvertisement_Event_REMOVED,
+	}
+	return c.send(&warden.AgentMessage{Advertisement: &w})
+}
+
+func (c *wardenClient) Acknowledge(req *warden.ClusterRequest, phase warden.RequestAck_Phase, msg string) error {
+	return c.ack(newAck(req, phase, codes.OK, msg))
+}
+
+func (c *wardenClient) ReportProgress(req *warden.ClusterRequest, step, steps uint32, msg string) error {
+	ack := newAck(req, warden.RequestAck_PROGRESS, codes.OK, msg)
+	ack.Step = step
+	ack.Steps = steps
+	return c.ack(ack)
+}
+
+func (c *wardenClient) Reject(req *warden.ClusterRequest, code codes.Code, msg string) error {
+	return c.ack(newAck(req, warden.RequestAck_REJECTED, code, msg))
+}
+
+func (c *wardenClient) ReportFailure(req *warden.ClusterRequest, code codes.Code, msg string) error {
+	return c.ack(newAck(req, warden.RequestAck_FAILED, code, msg))
+}
+
+func newAck(req *warden.ClusterRequest, phase warden.RequestAck_Phase, code codes.Code, msg string) *warden.RequestAck {
+	return &warden.RequestAck{
+		RequestId:   req.RequestId,
+		ClusterId:   req.ClusterId,
+		ClusterType: req.ClusterType,
+		Type:        req.Type,
+		Phase:       phase,
+		Code:        uint32(code),
+		Message:     msg,
+	}
+}
+
+func (c *wardenClient) ack(ack *warden.RequestAck) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.sendAck(ack)
+}
+
+// Sends the acknowledgement; the outcome of a request is kept until the next reconnect if it cannot
+// be sent, as the server would otherwise never learn of it
+func (c *wardenClient) sendAck(ack *warden.RequestAck) error {
+	// Note: callers must hold c.mux
+	err := c.send(&warden.AgentMessage{Ack: ack})
+	if err == nil || ack.Phase == warden.RequestAck_ACCEPTED || ack.Phase == warden.RequestAck_PROGRESS {
+		return err
+	}
+	grpclog.Printf("Failed to send %v of request %s; sending it once reconnected: %v", ack.Phase, ack.RequestId, err)
+	c.unsent = append(c.unsent, ack)
+	return nil
+}
+
+func (c *wardenClient) send(msg *warden.AgentMessage) (err error) {
+	// Note: callers must hold c.mux
+	if c.stream == nil {
+		return errors.New("not connected to the warden")
+	}
 	// TODO this is pretty rudimentary
 	// retry 3 times with back-off
 	for i := 1; i <= 3; i++ {
-		err = c.stream.Send(ad)
+		err = c.stream.Send(msg)
 		if err == nil {
 			return
 		}
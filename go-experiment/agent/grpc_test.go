@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc/codes"
+	"testing"
+)
+
+type recordingStream struct {
+	warden.ClusterAgentService_AgentClustersClient
+	sent []*warden.AgentMessage
+}
+
+func (s *recordingStream) Send(msg *warden.AgentMessage) error {
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func TestUnsentOutcomes(t *testing.T) {
+	c := &wardenClient{ads: make(map[string]*warden.ClusterAdvertisement)}
+	req := &warden.ClusterRequest{Type: warden.ClusterRequest_RESERVE, RequestId: "r1", ClusterId: "alpha", ClusterType: "onlab"}
+
+	// while disconnected, the outcome of a request is kept, but not its progress
+	if err := c.ReportProgress(req, 1, 2, "creating containers"); err == nil {
+		t.Error("Expected progress to fail while disconnected")
+	}
+	if err := c.ReportFailure(req, codes.Aborted, "interrupted"); err != nil {
+		t.Errorf("Expected the failure to be kept, got %v", err)
+	}
+	c.PublishUpdate(&warden.ClusterAdvertisement{ClusterId: "alpha", ClusterType: "onlab",
+		State: warden.ClusterAdvertisement_UNAVAILABLE, RequestId: "r1"})
+
+	// once reconnected, the cell is advertised before its reservation is failed
+	stream := &recordingStream{}
+	c.stream = stream
+	c.republish()
+	if len(stream.sent) != 2 || stream.sent[0].Advertisement == nil || stream.sent[1].Ack == nil ||
+		stream.sent[1].Ack.Phase != warden.RequestAck_FAILED || stream.sent[1].Ack.RequestId != "r1" {
+		t.Errorf("Expected the advertisement and then the failure, got %v", stream.sent)
+	}
+	if len(c.unsent) != 0 {
+		t.Errorf("Expected nothing left to send, got %v", c.unsent)
+	}
+}
+
+func TestWithdraw(t *testing.T) {
+	stream := &recordingStream{}
+	c := &wardenClient{stream: stream, ads: make(map[string]*warden.ClusterAdvertisement)}
+	ad := &warden.ClusterAdvertisement{ClusterId: "alpha", ClusterType: "onlab", State: warden.ClusterAdvertisement_AVAILABLE}
+	c.PublishUpdate(ad)
+	if err := c.Withdraw(ad); err != nil {
+		t.Fatal(err)
+	}
+	if w := stream.sent[1].Advertisement; w.Event == nil || w.Event.Type != warden.ClusterAdvertisement_Event_WITHDRAWN ||
+		w.Event.Reason != warden.ClusterAdvertisement_Event_REMOVED || ad.Event != nil {
+		t.Errorf("Expected a withdrawal of alpha, got %v", w)
+	}
+
+	// withdrawn clusters are not advertised again after a reconnect
+	stream.sent = nil
+	c.republish()
+	if len(stream.sent) != 0 {
+		t.Errorf("Expected nothing to be republished, got %v", stream.sent)
+	}
+}
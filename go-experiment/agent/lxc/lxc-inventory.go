@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Largest cell that the inventory may declare
+const maxCellSize = 20
+
+// Inventory of the cells hosted on the bare-metal machine, e.g.
+//
+//	{
+//	  "host": "10.192.19.220",
+//	  "gateway": "10.192.19.1",
+//	  "maxSize": 7,
+//	  "cells": [
+//	    {"name": "alpha", "ipStart": "10.192.19.100"},
+//	    {"name": "beta", "ipStart": "10.192.19.110", "maxSize": 9}
+//	  ]
+//	}
+//
+// Each cell takes the IP addresses from ipStart, for its mininet node, to ipStart+maxSize.
+type inventory struct {
+	Host    string       `json:"host"`    // address of the machine, advertised as the cells' head node
+	Gateway string       `json:"gateway"` // gateway of the containers' network
+	MaxSize uint32       `json:"maxSize"` // default maximum number of ONOS nodes of each cell
+	Cells   []cellConfig `json:"cells"`
+
+	// line of each top-level key
+	lines map[string]int
+}
+
+type cellConfig struct {
+	Name    string `json:"name"`
+	IPStart string `json:"ipStart"`
+	MaxSize uint32 `json:"maxSize"`
+
+	line int
+}
+
+// Error in the inventory file, located by line
+type inventoryError struct {
+	path string
+	line int
+	msg  string
+}
+
+func (e inventoryError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.path, e.line, e.msg)
+}
+
+// List of all the errors found in the inventory file
+type inventoryErrors []error
+
+func (e inventoryErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Returns the 1-based line of the byte at the given offset
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// Validates the contents of the inventory file at the given path
+func parseInventory(path string, data []byte) (*inventory, error) {
+	var inv inventory
+	if err := json.Unmarshal(data, &inv); err != nil {
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			return nil, inventoryError{path, lineAt(data, e.Offset), e.Error()}
+		case *json.UnmarshalTypeError:
+			return nil, inventoryError{path, lineAt(data, e.Offset), e.Error()}
+		}
+		return nil, inventoryError{path, 1, err.Error()}
+	}
+	keys, lines := inventoryLines(data)
+	inv.lines = keys
+	for i := range inv.Cells {
+		inv.Cells[i].line = 1
+		if i < len(lines) {
+			inv.Cells[i].line = lines[i]
+		}
+		if inv.Cells[i].MaxSize == 0 {
+			inv.Cells[i].MaxSize = inv.MaxSize
+		}
+	}
+	if errs := inv.validate(path); len(errs) > 0 {
+		return nil, errs
+	}
+	return &inv, nil
+}
+
+// Returns the line of each top-level key and the line on which each entry of the "cells" array
+// starts
+func inventoryLines(data []byte) (keys map[string]int, cells []int) {
+	keys = make(map[string]int)
+	r := bytes.NewReader(data)
+	dec := json.NewDecoder(r)
+	offset := func() int64 {
+		buffered, _ := ioutil.ReadAll(dec.Buffered())
+		return int64(len(data) - r.Len() - len(buffered))
+	}
+	// the start of the next value, skipping the separators that the decoder has yet to consume
+	next := func() int64 {
+		off := offset()
+		for off < int64(len(data)) && strings.IndexByte(" \t\r\n,", data[off]) >= 0 {
+			off++
+		}
+		return off
+	}
+
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return
+	}
+	for dec.More() {
+		start := next()
+		t, err := dec.Token()
+		if err != nil {
+			return
+		}
+		key, _ := t.(string)
+		keys[key] = lineAt(data, start)
+		if key != "cells" {
+			var skip json.RawMessage
+			if dec.Decode(&skip) != nil {
+				return
+			}
+			continue
+		}
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return
+		}
+		for dec.More() {
+			cells = append(cells, lineAt(data, next()))
+			var skip json.RawMessage
+			if dec.Decode(&skip) != nil {
+				return
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Returns the line of the top-level key, or 1 if it is missing
+func (inv *inventory) line(key string) int {
+	if line, ok := inv.lines[key]; ok {
+		return line
+	}
+	return 1
+}
+
+func parseIPv4(s string) (uint32, bool) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip), true
+}
+
+// Returns every problem with the inventory, so that they can all be fixed at once
+func (inv *inventory) validate(path string) inventoryErrors {
+	var errs inventoryErrors
+	fail := func(line int, format string, args ...interface{}) {
+		errs = append(errs, inventoryError{path, line, fmt.Sprintf(format, args...)})
+	}
+	if _, ok := parseIPv4(inv.Host); !ok {
+		fail(inv.line("host"), "host %q is not an IPv4 address", inv.Host)
+	}
+	if _, ok := parseIPv4(inv.Gateway); !ok {
+		fail(inv.line("gateway"), "gateway %q is not an IPv4 address", inv.Gateway)
+	}
+	if inv.MaxSize > maxCellSize {
+		fail(inv.line("maxSize"), "maxSize %d is larger than %d", inv.MaxSize, maxCellSize)
+	}
+
+	type ipRange struct {
+		name       string
+		start, end uint32
+	}
+	var ranges []ipRange
+	names := make(map[string]int)
+	for _, cell := range inv.Cells {
+		switch {
+		case cell.Name == "":
+			fail(cell.line, "cell has no name")
+		case strings.ContainsAny(cell.Name, "/ \t"):
+			fail(cell.line, "cell name %q may not contain slashes or spaces", cell.Name)
+		default:
+			if line, ok := names[cell.Name]; ok {
+				fail(cell.line, "cell %s is already declared on line %d", cell.Name, line)
+			}
+			names[cell.Name] = cell.line
+		}
+		if cell.MaxSize == 0 || cell.MaxSize > maxCellSize {
+			fail(cell.line, "cell %s must have a maxSize from 1 to %d", cell.Name, maxCellSize)
+		}
+		start, ok := parseIPv4(cell.IPStart)
+		if !ok {
+			fail(cell.line, "ipStart %q of cell %s is not an IPv4 address", cell.IPStart, cell.Name)
+			continue
+		}
+		r := ipRange{cell.Name, start, start + cell.MaxSize}
+		for _, o := range ranges {
+			if r.start <= o.end && o.start <= r.end {
+				fail(cell.line, "IP range of cell %s overlaps that of cell %s", cell.Name, o.name)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return errs
+}
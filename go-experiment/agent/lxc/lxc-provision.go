@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/agent/container"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Base containers from which the cell's nodes are cloned
+const (
+	baseOnos    = "base-onos"
+	baseMininet = "base-mininet"
+)
+
+// Reports a step of a request; steps is 0 if the total is unknown
+type progressFunc func(step, steps uint32, msg string)
+
+// Returns the name of the container of the given node; node 0 is the mininet node
+func nodeName(cell string, id uint32) string {
+	if id == 0 {
+		return cell + "-n"
+	}
+	return fmt.Sprintf("%s-%d", cell, id)
+}
+
+// Creates the containers of the cell's nodes, as the legacy create-cell and clone-node scripts did
+func (c *lxcClient) createCell(cell *lxcCell, key string, progress progressFunc) error {
+	key = strings.TrimSpace(key)
+	if err := addKey(c.hostKeys, key); err != nil {
+		return fmt.Errorf("unable to authorize key on host: %v", err)
+	}
+
+	t := &container.Template{
+		Clone:   container.CloneOptions{FSSize: "10G"},
+		Gateway: cell.gateway,
+		User:    "sdn",
+	}
+	keys := container.Keys{Authorized: []string{key}}
+	nodes := cell.ad.Nodes
+	steps := uint32(len(nodes))
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		done uint32
+		errs []string
+	)
+	wg.Add(len(nodes))
+	for _, n := range nodes {
+		go func(id uint32, ip string) {
+			defer wg.Done()
+			base := baseOnos
+			if id == 0 {
+				base = baseMininet
+			}
+			name := nodeName(cell.ad.ClusterId, id)
+			err := c.host.CreateNode(t, container.Node{Name: name, Base: base, IP: ip}, keys)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				return
+			}
+			done++
+			progress(done, steps, fmt.Sprintf("node %s ready at %s", name, ip))
+		}(n.Id, n.Ip)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to create %d of %d nodes: %s", len(errs), steps, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Destroys the containers of the cell's nodes that exist, as the legacy destroy-cell script did
+func (c *lxcClient) destroyNodes(cell *lxcCell) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	wg.Add(len(cell.ad.Nodes))
+	for _, n := range cell.ad.Nodes {
+		go func(name string) {
+			defer wg.Done()
+			if err := c.host.DestroyNode(name); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				mu.Unlock()
+			}
+		}(nodeName(cell.ad.ClusterId, n.Id))
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to destroy %d nodes: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Appends the key to the authorized_keys file, unless it is already there
+func addKey(path, key string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == key {
+			return nil
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, key)
+	return err
+}
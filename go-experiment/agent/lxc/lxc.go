@@ -1,47 +1,79 @@
 package main
 
 import (
-	"bufio"
 	"crypto/md5"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/opennetworkinglab/onos-warden/agent"
+	"github.com/opennetworkinglab/onos-warden/agent/container"
 	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"net"
 	"os"
-	"strconv"
-	"strings"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
-const configurationFile = "/Users/tom/cells.cfg"
-const maxCellSize = 20
+const clusterType = "onlab"
 
 type lxcCell struct {
 	ad             warden.ClusterAdvertisement
 	ipStart        string
-	md5            string
+	maxSize        uint32
+	gateway        string
+	md5            string // of the cell's configuration in the inventory
 	lastChanged    time.Time
 	lastAdvertised time.Time
 }
 
 type lxcClient struct {
-	client agent.WardenClient
-	cells  map[string]lxcCell
+	client   agent.WardenClient
+	cells    map[string]lxcCell
+	requests map[string]string
+	mux      sync.Mutex
 
-	// TODO information about the local bare-metal, i.e. name, cell names, ip-ranges, etc.
+	// cells whose containers are being created, each with the return that waits for it, if any
+	provisioning map[string]*warden.ClusterRequest
+
+	// inventory file describing the cells, and the hash of its last read
+	inventory     string
+	inventoryHash string
+	// directory holding the reservation of each cell, in place of the legacy .rez files
+	stateDir string
+	// the bare-metal machine on which the cells' containers run
+	host *container.Host
+	// authorized_keys of the bare-metal host, to which reserving users' keys are added
+	hostKeys string
+}
+
+// Reservation of a cell, persisted so that it survives restarts of the agent
+type reservation struct {
+	RequestId   string                                       `json:"requestId"`
+	Size        uint32                                       `json:"size"`
+	Provisioned bool                                         `json:"provisioned"`
+	Info        *warden.ClusterAdvertisement_ReservationInfo `json:"info"`
 }
 
 // Creates a new LXC agent worker
 func NewAgentWorker() (agent.Worker, error) {
 	var c lxcClient
 	c.cells = make(map[string]lxcCell)
+	c.requests = make(map[string]string)
+	c.provisioning = make(map[string]*warden.ClusterRequest)
+	c.host = &container.Host{Runner: container.Local{}}
 	return &c, nil
 }
 
 func (c *lxcClient) Start() {
 	go func() {
 		for {
-			c.readConfiguration()
+			c.reloadInventory()
 			c.sendUpdates()
 			time.Sleep(5 * time.Second)
 		}
@@ -52,99 +84,524 @@ func (c *lxcClient) Bind(client agent.WardenClient) {
 	c.client = client
 }
 
+func (c *lxcClient) Registration() *warden.AgentRegistration {
+	return &warden.AgentRegistration{
+		ClusterType:  clusterType,
+		Capabilities: []string{"reserve", "extend", "return", "ack"},
+	}
+}
+
 func (c *lxcClient) Teardown() {
-	//TODO
+	// Containers and reservations outlive the agent; they are picked up again when it restarts
 }
 
 func (c *lxcClient) Handle(req *warden.ClusterRequest) {
-	//TODO
+	if req.ClusterType != "" && req.ClusterType != clusterType {
+		c.reject(req, codes.InvalidArgument, "Cannot handle cluster type "+req.ClusterType)
+		return
+	}
+
+	switch req.Type {
+	case warden.ClusterRequest_RESERVE:
+		cell, err := c.reserveCell(req)
+		if err != nil {
+			c.reject(req, codes.FailedPrecondition, err.Error())
+			return
+		}
+		c.ack(req, warden.RequestAck_ACCEPTED, "reserved cell "+cell.ad.ClusterId)
+		go c.provisionCell(req, cell)
+
+	case warden.ClusterRequest_EXTEND:
+		cell, err := c.extendCell(req)
+		if err != nil {
+			c.reject(req, codes.FailedPrecondition, err.Error())
+			return
+		}
+		c.ack(req, warden.RequestAck_COMPLETED, "extended reservation of cell "+cell.ad.ClusterId)
+
+	case warden.ClusterRequest_RETURN:
+		cell, deferred, err := c.releaseCell(req)
+		if err != nil {
+			c.reject(req, codes.FailedPrecondition, err.Error())
+			return
+		}
+		c.ack(req, warden.RequestAck_ACCEPTED, "destroying cell "+cell.ad.ClusterId)
+		if !deferred {
+			go c.destroyCell(req, cell)
+		}
+
+	default:
+		c.reject(req, codes.Unimplemented, fmt.Sprintf("Unsupported request type %v", req.Type))
+	}
 }
 
-// Reads the cell configuration file and populates this agent's internal structures.
-func (c *lxcClient) readConfiguration() {
-	f, err := os.Open(configurationFile)
+// Logs the refused request and reports it to the warden
+func (c *lxcClient) reject(req *warden.ClusterRequest, code codes.Code, msg string) {
+	fmt.Println(msg, req)
+	if err := c.client.Reject(req, code, msg); err != nil {
+		fmt.Println("Unable to report rejection of request", req.RequestId, err)
+	}
+}
+
+// Logs the failure of the accepted request and reports it to the warden
+func (c *lxcClient) fail(req *warden.ClusterRequest, code codes.Code, msg string) {
+	fmt.Println(msg, req)
+	if err := c.client.ReportFailure(req, code, msg); err != nil {
+		fmt.Println("Unable to report failure of request", req.RequestId, err)
+	}
+}
+
+// Tells the warden how far the request has got
+func (c *lxcClient) ack(req *warden.ClusterRequest, phase warden.RequestAck_Phase, msg string) {
+	if err := c.client.Acknowledge(req, phase, msg); err != nil {
+		fmt.Println("Unable to acknowledge request", req.RequestId, err)
+	}
+}
+
+// Returns the cell that the request refers to, either by its request id or its cluster id
+// You must hold c.mux before calling this method
+func (c *lxcClient) findCell(req *warden.ClusterRequest) (lxcCell, error) {
+	cId := req.ClusterId
+	if v, ok := c.requests[req.RequestId]; ok && req.RequestId != "" {
+		if cId != "" && cId != v {
+			return lxcCell{}, fmt.Errorf("cell %s does not match the reserved cell %s", cId, v)
+		}
+		cId = v
+	}
+	if cId != "" {
+		cell, ok := c.cells[cId]
+		if !ok {
+			return lxcCell{}, fmt.Errorf("cell %s not found", cId)
+		}
+		return cell, nil
+	}
+	if req.Type == warden.ClusterRequest_RESERVE {
+		for _, cell := range c.cells {
+			if cell.ad.State == warden.ClusterAdvertisement_AVAILABLE {
+				return cell, nil
+			}
+		}
+		return lxcCell{}, errors.New("no available cells")
+	}
+	return lxcCell{}, fmt.Errorf("no cell reserved for request %s", req.RequestId)
+}
+
+func (c *lxcClient) reserveCell(req *warden.ClusterRequest) (lxcCell, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	cell, err := c.findCell(req)
 	if err != nil {
-		panic(err)
+		return cell, err
+	}
+	if cell.ad.State != warden.ClusterAdvertisement_AVAILABLE {
+		return cell, fmt.Errorf("cell %s is not available", cell.ad.ClusterId)
+	}
+	if req.Spec == nil {
+		return cell, errors.New("reservation has no spec")
+	}
+	if req.Spec.ControllerNodes > cell.maxSize {
+		return cell, fmt.Errorf("cell %s cannot fit %d controller nodes", cell.ad.ClusterId, req.Spec.ControllerNodes)
 	}
-	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		cell := c.cellConfig(scanner.Text())
-		c.cells[cell.ad.ClusterId] = cell
+	rez := reservation{
+		RequestId: req.RequestId,
+		Size:      req.Spec.ControllerNodes,
+		Info: &warden.ClusterAdvertisement_ReservationInfo{
+			UserName:             req.Spec.UserName,
+			Duration:             req.Duration,
+			ReservationStartTime: time.Now().Unix(),
+		},
 	}
+	if err := c.writeReservation(cell.ad.ClusterId, &rez); err != nil {
+		return cell, fmt.Errorf("unable to persist reservation of cell %s: %v", cell.ad.ClusterId, err)
+	}
+	applyReservation(&cell, &rez)
+	c.publish(cell)
+	c.provisioning[cell.ad.ClusterId] = nil
+	return cell, nil
 }
 
-// Reads the current cell configuration from the environment.
-func (c *lxcClient) cellConfig(cfg string) lxcCell {
-	var cell lxcCell
-	hash := md5.Sum([]byte(cfg))
-	md5 := hex.EncodeToString(hash[:])
+func (c *lxcClient) extendCell(req *warden.ClusterRequest) (lxcCell, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 
-	// cellName, ipStart
-	fields := strings.Split(cfg, ",")
-	name, ipStart := fields[0], fields[1]
+	cell, err := c.findCell(req)
+	if err != nil {
+		return cell, err
+	}
+	rez, err := c.readReservation(cell.ad.ClusterId)
+	if err != nil || rez == nil || rez.RequestId != req.RequestId {
+		return cell, fmt.Errorf("cell %s is not reserved for request %s", cell.ad.ClusterId, req.RequestId)
+	}
+	// the reservation lasts for the requested duration from now
+	past := time.Since(time.Unix(rez.Info.ReservationStartTime, 0))
+	rez.Info.Duration = int32(float64(req.Duration) + past.Minutes())
+	if err := c.writeReservation(cell.ad.ClusterId, rez); err != nil {
+		return cell, fmt.Errorf("unable to persist reservation of cell %s: %v", cell.ad.ClusterId, err)
+	}
+	applyReservation(&cell, rez)
+	c.publish(cell)
+	return cell, nil
+}
 
-	cell.ad.ClusterId = name
-	cell.ad.ClusterType = "onlab"
-	cell.ad.HeadNodeIP = ipStart
-	cell.ipStart = ipStart
+// Marks the reserved cell unavailable while its containers are destroyed; returns true if the
+// containers are still being created, in which case they are destroyed once that is over
+func (c *lxcClient) releaseCell(req *warden.ClusterRequest) (lxcCell, bool, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	cell, err := c.findCell(req)
+	if err != nil {
+		return cell, false, err
+	}
+	if cell.ad.RequestId != req.RequestId {
+		return cell, false, fmt.Errorf("cell %s is not reserved for request %s", cell.ad.ClusterId, req.RequestId)
+	}
+	cell.ad.State = warden.ClusterAdvertisement_UNAVAILABLE
+	c.publish(cell)
+	if _, ok := c.provisioning[cell.ad.ClusterId]; ok {
+		c.provisioning[cell.ad.ClusterId] = req
+		return cell, true, nil
+	}
+	return cell, false, nil
+}
 
-	if cell.md5 != md5 {
-		cell.lastChanged = time.Now()
+// Creates the containers of the reserved cell and advertises it as ready, or releases it if
+// any of them could not be created; a return of the cell that arrived meanwhile is carried out
+// once the containers are no longer being created
+func (c *lxcClient) provisionCell(req *warden.ClusterRequest, cell lxcCell) {
+	progress := func(step, steps uint32, msg string) {
+		fmt.Println(msg)
+		if err := c.client.ReportProgress(req, step, steps, msg); err != nil {
+			fmt.Println("Unable to report progress of request", req.RequestId, err)
+		}
+	}
+	name := cell.ad.ClusterId
+	err := c.createCell(&cell, req.Spec.UserKey, progress)
+	if err != nil {
+		c.fail(req, codes.Internal, fmt.Sprintf("Unable to provision cell %s: %v", name, err))
+		c.destroyNodes(&cell)
 	}
 
-	cell.ad.ReservationInfo = c.readReservation(name)
+	c.mux.Lock()
+	ret := c.provisioning[name]
+	delete(c.provisioning, name)
+	var rerr error
+	if err == nil {
+		rerr = c.completeReservation(req, &cell, ret != nil)
+	} else if ret == nil {
+		c.clearReservation(name)
+	}
+	c.mux.Unlock()
 
-	fmt.Println(cfg)
-	return cell
+	if rerr != nil {
+		c.fail(req, codes.Aborted, fmt.Sprintf("Unable to complete reservation of cell %s: %v", name, rerr))
+	} else if err == nil {
+		c.ack(req, warden.RequestAck_COMPLETED, "provisioned cell "+name)
+	}
+	if ret != nil {
+		c.destroyCell(ret, cell)
+	}
 }
 
-// Reads the current reservation data from the current file; returns nil if there
-// is no reservation.
-func (c *lxcClient) readReservation(cell string) *warden.ClusterAdvertisement_ReservationInfo {
-	f, err := os.Open("/Users/tom/" + cell + ".rez")
+// Fails the reservation of a cell whose provisioning was cut short by a restart of the agent,
+// destroys whatever containers were created and advertises the cell as available again
+func (c *lxcClient) abortProvisioning(cell lxcCell) {
+	name := cell.ad.ClusterId
+	req := &warden.ClusterRequest{Type: warden.ClusterRequest_RESERVE, RequestId: cell.ad.RequestId,
+		ClusterId: name, ClusterType: clusterType}
+	c.fail(req, codes.Aborted, fmt.Sprintf("Provisioning of cell %s was interrupted by a restart of the agent", name))
+	err := c.destroyNodes(&cell)
 	if err != nil {
-		return nil
+		// leave the cell unavailable, so that it is not handed out with stray containers; the
+		// reservation is kept, so that the next start of the agent tries again
+		fmt.Println("Unable to destroy interrupted cell", name, err)
 	}
-	defer f.Close()
 
-	// read from file called '<cellName>.rez'
-	// user, startTime, duration, cellSize
-	scanner := bufio.NewScanner(f)
-	scanner.Scan()
-	fields := strings.Split(scanner.Text(), ",")
+	c.mux.Lock()
+	ret := c.provisioning[name]
+	delete(c.provisioning, name)
+	if err == nil && ret == nil {
+		c.clearReservation(name)
+	}
+	c.mux.Unlock()
 
-	startTime, err := strconv.ParseUint(strings.Trim(fields[1], " "), 10, 32)
+	if ret != nil {
+		c.destroyCell(ret, cell)
+	}
+}
+
+// Marks the reservation of the cell as provisioned and advertises the cell as ready, unless the
+// cell was removed or returned while it was being provisioned
+// You must hold c.mux before calling this method
+func (c *lxcClient) completeReservation(req *warden.ClusterRequest, cell *lxcCell, returned bool) error {
+	if _, ok := c.cells[cell.ad.ClusterId]; !ok {
+		return errors.New("cell was removed from the inventory while it was being provisioned")
+	}
+	rez, err := c.readReservation(cell.ad.ClusterId)
 	if err != nil {
-		panic("Invalid time:" + fields[1])
+		return err
 	}
+	if returned || rez == nil || rez.RequestId != req.RequestId {
+		return errors.New("reservation was returned while the cell was being provisioned")
+	}
+	rez.Provisioned = true
+	err = c.writeReservation(cell.ad.ClusterId, rez)
+	applyReservation(cell, rez)
+	c.publish(*cell)
+	return err
+}
+
+// Destroys the containers of the returned cell and advertises it as available again
+func (c *lxcClient) destroyCell(req *warden.ClusterRequest, cell lxcCell) {
+	if err := c.destroyNodes(&cell); err != nil {
+		// leave the cell unavailable, so that it is not handed out with stray containers
+		c.fail(req, codes.Internal, fmt.Sprintf("Unable to destroy cell %s: %v", cell.ad.ClusterId, err))
+		return
+	}
+	c.clearCell(cell.ad.ClusterId)
+	c.ack(req, warden.RequestAck_COMPLETED, "destroyed cell "+cell.ad.ClusterId)
+}
+
+// Removes the reservation of the cell and advertises it as available
+func (c *lxcClient) clearCell(name string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.clearReservation(name)
+}
+
+// You must hold c.mux before calling this method
+func (c *lxcClient) clearReservation(name string) {
+	if err := c.removeReservation(name); err != nil {
+		fmt.Println("Unable to remove reservation of cell", name, err)
+	}
+	cell, ok := c.cells[name]
+	if !ok {
+		return
+	}
+	applyReservation(&cell, nil)
+	c.publish(cell)
+}
+
+// Stores the cell and advertises it right away
+// You must hold c.mux before calling this method
+func (c *lxcClient) publish(cell lxcCell) {
+	if old, ok := c.cells[cell.ad.ClusterId]; ok && old.ad.RequestId != "" && old.ad.RequestId != cell.ad.RequestId {
+		delete(c.requests, old.ad.RequestId)
+	}
+	if cell.ad.RequestId != "" {
+		c.requests[cell.ad.RequestId] = cell.ad.ClusterId
+	}
+	cell.lastChanged = time.Now()
+	cell.lastAdvertised = cell.lastChanged
+	c.cells[cell.ad.ClusterId] = cell
+	c.client.PublishUpdate(&cell.ad)
+}
+
+// Sets the state, nodes and reservation info of the cell from its reservation, if any
+func applyReservation(cell *lxcCell, rez *reservation) {
+	if rez == nil {
+		cell.ad.State = warden.ClusterAdvertisement_AVAILABLE
+		cell.ad.RequestId = ""
+		cell.ad.ReservationInfo = nil
+		cell.ad.Nodes = nil
+		return
+	}
+	cell.ad.State = warden.ClusterAdvertisement_RESERVED
+	if rez.Provisioned {
+		cell.ad.State = warden.ClusterAdvertisement_READY
+	}
+	cell.ad.RequestId = rez.RequestId
+	cell.ad.ReservationInfo = rez.Info
+	cell.ad.Nodes = cellNodes(cell.ipStart, rez.Size)
+}
+
+// Returns the nodes of a cell of the given size: the mininet node 0 at the start of the cell's IP
+// range, followed by the ONOS nodes
+func cellNodes(ipStart string, size uint32) []*warden.ClusterAdvertisement_ClusterNode {
+	base, ok := parseIPv4(ipStart)
+	if !ok {
+		fmt.Println("Invalid IP start", ipStart)
+		return nil
+	}
+	nodes := make([]*warden.ClusterAdvertisement_ClusterNode, size+1)
+	for i := range nodes {
+		nip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(nip, base+uint32(i))
+		nodes[i] = &warden.ClusterAdvertisement_ClusterNode{Id: uint32(i), Ip: nip.String()}
+	}
+	return nodes
+}
+
+// Reads the inventory file, if it has changed since the last read, and applies it; an invalid
+// inventory is reported and ignored, so that the cells of the previous one remain in service
+func (c *lxcClient) reloadInventory() {
+	data, err := ioutil.ReadFile(c.inventory)
+	hash := md5.Sum(data)
+	if err != nil {
+		hash = md5.Sum([]byte(err.Error()))
+	}
+	sum := hex.EncodeToString(hash[:])
+	if sum == c.inventoryHash {
+		return
+	}
+	// report each problem once, until the file changes
+	c.inventoryHash = sum
+	if err != nil {
+		fmt.Println("Unable to read inventory:", err)
+		return
+	}
+	inv, err := parseInventory(c.inventory, data)
+	if err != nil {
+		fmt.Printf("Ignoring invalid inventory:\n%v\n", err)
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.applyInventory(inv)
+}
+
+// Adds, updates and removes cells to match the inventory, advertising each cell that changed
+// You must hold c.mux before calling this method
+func (c *lxcClient) applyInventory(inv *inventory) {
+	names := make(map[string]bool)
+	for _, cfg := range inv.Cells {
+		names[cfg.Name] = true
+		hash := md5.Sum([]byte(fmt.Sprintf("%s,%s,%d,%s,%s", cfg.Name, cfg.IPStart, cfg.MaxSize, inv.Host, inv.Gateway)))
+		sum := hex.EncodeToString(hash[:])
+
+		cell, ok := c.cells[cfg.Name]
+		if ok && cell.md5 == sum {
+			continue
+		}
+		cell.md5 = sum
+		cell.ad.ClusterId = cfg.Name
+		cell.ad.ClusterType = clusterType
+		cell.ad.HeadNodeIP = inv.Host
+		cell.ad.Capacity = &warden.ClusterAdvertisement_Capacity{
+			MaxControllerNodes: cfg.MaxSize,
+			Features:           []string{"mininet"},
+		}
+		cell.ipStart = cfg.IPStart
+		cell.maxSize = cfg.MaxSize
+		cell.gateway = inv.Gateway
+
+		abort := false
+		if ok {
+			// the agent tracks the state of known cells; the nodes of a reserved cell keep the
+			// addresses with which they were created until it is returned
+			fmt.Println("Updated cell", cfg.Name)
+		} else {
+			rez, err := c.readReservation(cfg.Name)
+			if err != nil {
+				fmt.Println("Ignoring reservation of cell", cfg.Name, err)
+				rez = nil
+			}
+			applyReservation(&cell, rez)
+			if rez != nil && !rez.Provisioned {
+				// the agent stopped while the cell's containers were being created, and nothing
+				// is left to finish creating them
+				cell.ad.State = warden.ClusterAdvertisement_UNAVAILABLE
+				c.provisioning[cfg.Name] = nil
+				abort = true
+			}
+			fmt.Println("Added cell", cfg.Name)
+		}
+		c.publish(cell)
+		if abort {
+			// fail the reservation only once the cell is advertised, so that the warden knows
+			// that the cell is this agent's again
+			go c.abortProvisioning(cell)
+		}
+	}
+
+	for name, cell := range c.cells {
+		if names[name] {
+			continue
+		}
+		// the reservation file is kept, so that the reservation is restored if the cell comes back
+		if cell.ad.RequestId != "" {
+			fmt.Println("Removed cell", name, "while reserved by request", cell.ad.RequestId)
+			delete(c.requests, cell.ad.RequestId)
+		} else {
+			fmt.Println("Removed cell", name)
+		}
+		delete(c.cells, name)
+		if err := c.client.Withdraw(&cell.ad); err != nil {
+			fmt.Println("Unable to withdraw cell", name, err)
+		}
+	}
+}
+
+func (c *lxcClient) reservationFile(cell string) string {
+	return filepath.Join(c.stateDir, cell+".json")
+}
 
-	duration, err := strconv.ParseInt(strings.Trim(fields[2], " "), 10, 32)
+// Reads the reservation of the cell; returns nil if there is no reservation.
+func (c *lxcClient) readReservation(cell string) (*reservation, error) {
+	b, err := ioutil.ReadFile(c.reservationFile(cell))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var rez reservation
+	if err := json.Unmarshal(b, &rez); err != nil {
+		return nil, err
+	}
+	if rez.RequestId == "" || rez.Info == nil {
+		return nil, fmt.Errorf("reservation in %s is incomplete", c.reservationFile(cell))
+	}
+	return &rez, nil
+}
+
+// Persists the reservation of the cell, replacing the file atomically
+func (c *lxcClient) writeReservation(cell string, rez *reservation) error {
+	b, err := json.Marshal(rez)
 	if err != nil {
-		panic("Invalid duration")
+		return err
 	}
+	path := c.reservationFile(cell)
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
 
-	return &warden.ClusterAdvertisement_ReservationInfo{
-		UserName:             fields[0],
-		ReservationStartTime: uint32(startTime),
-		Duration:             int32(duration),
+func (c *lxcClient) removeReservation(cell string) error {
+	err := os.Remove(c.reservationFile(cell))
+	if os.IsNotExist(err) {
+		return nil
 	}
+	return err
 }
 
 // Sweeps through all the cells and sends an update if the cell status has
 // changed since the last time we send an advertisement.
 func (c *lxcClient) sendUpdates() {
-	for _, cell := range c.cells {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for name, cell := range c.cells {
 		if cell.lastAdvertised.Before(cell.lastChanged) {
 			c.client.PublishUpdate(&cell.ad)
 			cell.lastAdvertised = time.Now()
+			c.cells[name] = cell
 		}
 	}
-
 }
 
 // Runs Warden agent using LXC worker on internal bare-metal machines.
 func main() {
-	agent.Run(NewAgentWorker())
+	w, err := NewAgentWorker()
+	c := w.(*lxcClient)
+	flag.StringVar(&c.inventory, "inventory", "/etc/warden/cells.json", "JSON inventory of the cells hosted on this machine")
+	flag.StringVar(&c.stateDir, "stateDir", "/var/lib/warden", "Directory in which cell reservations are kept")
+	flag.StringVar(&c.hostKeys, "hostKeys", "/home/sdn/.ssh/authorized_keys", "authorized_keys file of the host to which users' keys are added")
+	flag.Parse()
+	if err == nil {
+		err = os.MkdirAll(c.stateDir, 0755)
+	}
+	agent.Run(w, err)
 }
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/agent"
+	"github.com/opennetworkinglab/onos-warden/agent/container"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReservationPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warden-lxc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &lxcClient{stateDir: dir}
+
+	if rez, err := c.readReservation("a"); rez != nil || err != nil {
+		t.Fatalf("Expected no reservation, got %v (%v)", rez, err)
+	}
+	rez := &reservation{RequestId: "tom", Size: 3,
+		Info: &warden.ClusterAdvertisement_ReservationInfo{UserName: "tom", Duration: 60, ReservationStartTime: 1488794400}}
+	if err := c.writeReservation("a", rez); err != nil {
+		t.Fatal(err)
+	}
+	read, err := c.readReservation("a")
+	if err != nil || read.RequestId != "tom" || read.Size != 3 || read.Info.ReservationStartTime != 1488794400 {
+		t.Fatalf("Unexpected reservation %v (%v)", read, err)
+	}
+
+	cell := lxcCell{ipStart: "10.192.19.100"}
+	applyReservation(&cell, read)
+	if cell.ad.State != warden.ClusterAdvertisement_RESERVED || len(cell.ad.Nodes) != 4 {
+		t.Errorf("Expected a reserved cell of 3 nodes and mininet, got %v", cell.ad)
+	}
+	if n := cell.ad.Nodes[3]; n.Id != 3 || n.Ip != "10.192.19.103" || nodeName("a", n.Id) != "a-3" {
+		t.Errorf("Unexpected node %v", n)
+	}
+	read.Provisioned = true
+	applyReservation(&cell, read)
+	if cell.ad.State != warden.ClusterAdvertisement_READY {
+		t.Errorf("Expected a ready cell, got %v", cell.ad.State)
+	}
+
+	if err := c.removeReservation("a"); err != nil {
+		t.Fatal(err)
+	}
+	if rez, err := c.readReservation("a"); rez != nil || err != nil {
+		t.Errorf("Expected the reservation to be removed, got %v (%v)", rez, err)
+	}
+	applyReservation(&cell, nil)
+	if cell.ad.State != warden.ClusterAdvertisement_AVAILABLE || cell.ad.Nodes != nil {
+		t.Errorf("Expected an available cell, got %v", cell.ad)
+	}
+}
+
+func TestParseInventory(t *testing.T) {
+	inv, err := parseInventory("cells.json", []byte(`{
+  "host": "10.192.19.220",
+  "gateway": "10.192.19.1",
+  "maxSize": 7,
+  "cells": [
+    {"name": "alpha", "ipStart": "10.192.19.100"},
+    {"name": "beta", "ipStart": "10.192.19.110", "maxSize": 9}
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inv.Cells) != 2 || inv.Cells[0].MaxSize != 7 || inv.Cells[1].MaxSize != 9 || inv.Cells[1].line != 7 {
+		t.Errorf("Unexpected inventory %+v", inv)
+	}
+
+	_, err = parseInventory("cells.json", []byte(`{
+  "host": "10.192.19.220",
+  "gateway": "gateway",
+  "maxSize": 7,
+  "cells": [
+    {"name": "alpha", "ipStart": "10.192.19.100"},
+    {"name": "alpha", "ipStart": "10.192.19.104", "maxSize": 30},
+    {"name": "gamma", "ipStart": "10.192.19"}
+  ]
+}`))
+	expected := []string{
+		`cells.json:3: gateway "gateway" is not an IPv4 address`,
+		`cells.json:7: cell alpha is already declared on line 6`,
+		`cells.json:7: cell alpha must have a maxSize from 1 to 20`,
+		`cells.json:7: IP range of cell alpha overlaps that of cell alpha`,
+		`cells.json:8: ipStart "10.192.19" of cell gamma is not an IPv4 address`,
+	}
+	if err == nil || err.Error() != strings.Join(expected, "\n") {
+		t.Errorf("Expected errors:\n%s\ngot:\n%v", strings.Join(expected, "\n"), err)
+	}
+
+	_, err = parseInventory("cells.json", []byte("{\n  \"host\": \"10.192.19.220\",\n  \"maxSize\": \"7\"\n}"))
+	if err == nil || !strings.HasPrefix(err.Error(), "cells.json:3: ") {
+		t.Errorf("Expected a type error on line 3, got %v", err)
+	}
+	_, err = parseInventory("cells.json", []byte("{\n  \"host\": \"10.192.19.220\"\n  \"maxSize\": 7\n}"))
+	if err == nil || !strings.HasPrefix(err.Error(), "cells.json:3: ") {
+		t.Errorf("Expected a syntax error on line 3, got %v", err)
+	}
+}
+
+// Records the advertisements published by the worker, and the replies to its requests
+type recordingClient struct {
+	agent.WardenClient
+	mux     sync.Mutex
+	ads     []warden.ClusterAdvertisement
+	replies []string
+}
+
+func (r *recordingClient) Withdraw(ad *warden.ClusterAdvertisement) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	w := *ad
+	w.Event = &warden.ClusterAdvertisement_Event{Type: warden.ClusterAdvertisement_Event_WITHDRAWN}
+	r.ads = append(r.ads, w)
+	return nil
+}
+
+func (r *recordingClient) PublishUpdate(ad *warden.ClusterAdvertisement) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.ads = append(r.ads, *ad)
+	return nil
+}
+
+func (r *recordingClient) reply(req *warden.ClusterRequest, s string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.replies = append(r.replies, fmt.Sprintf("%v %s", req.Type, s))
+	return nil
+}
+
+func (r *recordingClient) Acknowledge(req *warden.ClusterRequest, phase warden.RequestAck_Phase, msg string) error {
+	return r.reply(req, phase.String())
+}
+
+func (r *recordingClient) ReportProgress(req *warden.ClusterRequest, step, steps uint32, msg string) error {
+	return nil
+}
+
+func (r *recordingClient) ReportFailure(req *warden.ClusterRequest, code codes.Code, msg string) error {
+	return r.reply(req, code.String())
+}
+
+func (r *recordingClient) Reject(req *warden.ClusterRequest, code codes.Code, msg string) error {
+	return r.reply(req, "rejected "+code.String())
+}
+
+func TestApplyInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warden-lxc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, _ := NewAgentWorker()
+	c := w.(*lxcClient)
+	c.stateDir = dir
+	rc := &recordingClient{}
+	c.Bind(rc)
+
+	rez := &reservation{RequestId: "r1", Size: 3, Provisioned: true,
+		Info: &warden.ClusterAdvertisement_ReservationInfo{UserName: "tom", Duration: 60, ReservationStartTime: 1488794400}}
+	if err := c.writeReservation("beta", rez); err != nil {
+		t.Fatal(err)
+	}
+	inv := &inventory{Host: "10.192.19.220", Gateway: "10.192.19.1", Cells: []cellConfig{
+		{Name: "alpha", IPStart: "10.192.19.100", MaxSize: 7},
+		{Name: "beta", IPStart: "10.192.19.110", MaxSize: 9},
+	}}
+	published := func(expected ...string) {
+		var names []string
+		for _, ad := range rc.ads {
+			if ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_WITHDRAWN {
+				names = append(names, ad.ClusterId+":WITHDRAWN")
+			} else {
+				names = append(names, ad.ClusterId+":"+ad.State.String())
+			}
+		}
+		if strings.Join(names, " ") != strings.Join(expected, " ") {
+			t.Errorf("Expected %v to be published, got %v", expected, names)
+		}
+		rc.ads = nil
+	}
+
+	c.applyInventory(inv)
+	published("alpha:AVAILABLE", "beta:READY")
+	if c.requests["r1"] != "beta" || len(c.cells["beta"].ad.Nodes) != 4 || c.cells["beta"].ad.HeadNodeIP != "10.192.19.220" {
+		t.Errorf("Expected the reservation of beta to be restored, got %v", c.cells["beta"].ad)
+	}
+
+	// unchanged cells are not advertised again
+	c.applyInventory(inv)
+	published()
+
+	// changed cells keep their reservation; removed cells are withdrawn
+	inv.Cells = []cellConfig{{Name: "beta", IPStart: "10.192.19.110", MaxSize: 12}}
+	c.applyInventory(inv)
+	published("beta:READY", "alpha:WITHDRAWN")
+	if _, ok := c.cells["alpha"]; ok {
+		t.Error("Expected alpha to be removed")
+	}
+	if beta := c.cells["beta"]; beta.maxSize != 12 || beta.ad.Capacity.MaxControllerNodes != 12 || beta.ad.RequestId != "r1" {
+		t.Errorf("Expected beta to be updated, got %v", beta.ad)
+	}
+
+	inv.Cells = nil
+	c.applyInventory(inv)
+	published("beta:WITHDRAWN")
+	if _, ok := c.requests["r1"]; ok {
+		t.Error("Expected the request of the removed cell to be forgotten")
+	}
+	if rez, _ := c.readReservation("beta"); rez == nil {
+		t.Error("Expected the reservation of the removed cell to be kept")
+	}
+}
+
+func TestReturnWhileProvisioning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warden-lxc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, _ := NewAgentWorker()
+	c := w.(*lxcClient)
+	c.stateDir = dir
+	c.hostKeys = filepath.Join(dir, "authorized_keys")
+	rc := &recordingClient{}
+	c.Bind(rc)
+
+	// keep track of the containers, and hold their creation until the cell has been returned
+	var mux sync.Mutex
+	containers := make(map[string]bool)
+	started := make(chan struct{})
+	rec := &container.Recorder{Reply: func(node string, step int, cmd string) (string, error) {
+		args := strings.Fields(cmd)
+		mux.Lock()
+		defer mux.Unlock()
+		switch args[1] {
+		case "lxc-copy":
+			containers[args[5]] = true
+		case "lxc-destroy":
+			delete(containers, args[3])
+		case "lxc-ls":
+			var names []string
+			for name := range containers {
+				names = append(names, name)
+			}
+			return strings.Join(names, "\n"), nil
+		case "lxc-start":
+			mux.Unlock()
+			<-started
+			mux.Lock()
+		}
+		return "", nil
+	}}
+	c.host = &container.Host{Runner: rec.Node("host")}
+	c.applyInventory(&inventory{Host: "10.192.19.220", Gateway: "10.192.19.1", Cells: []cellConfig{
+		{Name: "alpha", IPStart: "10.192.19.100", MaxSize: 3},
+	}})
+
+	c.Handle(&warden.ClusterRequest{Type: warden.ClusterRequest_RESERVE, RequestId: "r1", Duration: 60,
+		Spec: &warden.ClusterRequest_Spec{ControllerNodes: 1, UserName: "tom", UserKey: "ssh-rsa AAAA tom"}})
+	c.Handle(&warden.ClusterRequest{Type: warden.ClusterRequest_RETURN, RequestId: "r1"})
+	close(started)
+
+	// the return is carried out once the containers have been created
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		rc.mux.Lock()
+		n := len(rc.replies)
+		rc.mux.Unlock()
+		if n == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the return to complete, got %v", rc.replies)
+		}
+	}
+	expected := "RESERVE ACCEPTED,RETURN ACCEPTED,RESERVE Aborted,RETURN COMPLETED"
+	if replies := strings.Join(rc.replies, ","); replies != expected {
+		t.Errorf("Expected replies %s, got %s", expected, replies)
+	}
+	mux.Lock()
+	if len(containers) != 0 {
+		t.Errorf("Expected the containers to be destroyed, got %v", containers)
+	}
+	mux.Unlock()
+	for _, ad := range rc.ads {
+		if ad.State == warden.ClusterAdvertisement_READY {
+			t.Errorf("Expected the returned cell never to be advertised as ready, got %v", ad)
+		}
+	}
+	if last := rc.ads[len(rc.ads)-1]; last.State != warden.ClusterAdvertisement_AVAILABLE || last.RequestId != "" {
+		t.Errorf("Expected the cell to be available again, got %v", last)
+	}
+}
+
+func TestInterruptedProvisioning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warden-lxc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, _ := NewAgentWorker()
+	c := w.(*lxcClient)
+	c.stateDir = dir
+	rc := &recordingClient{}
+	c.Bind(rc)
+
+	// the agent stopped after creating one of the containers of alpha
+	var mux sync.Mutex
+	containers := map[string]bool{"alpha-n": true}
+	rec := &container.Recorder{Reply: func(node string, step int, cmd string) (string, error) {
+		args := strings.Fields(cmd)
+		mux.Lock()
+		defer mux.Unlock()
+		switch args[1] {
+		case "lxc-destroy":
+			delete(containers, args[3])
+		case "lxc-ls":
+			var names []string
+			for name := range containers {
+				names = append(names, name)
+			}
+			return strings.Join(names, "\n"), nil
+		}
+		return "", nil
+	}}
+	c.host = &container.Host{Runner: rec.Node("host")}
+	rez := &reservation{RequestId: "r1", Size: 1,
+		Info: &warden.ClusterAdvertisement_ReservationInfo{UserName: "tom", Duration: -1, ReservationStartTime: 1488794400}}
+	if err := c.writeReservation("alpha", rez); err != nil {
+		t.Fatal(err)
+	}
+
+	c.mux.Lock()
+	c.applyInventory(&inventory{Host: "10.192.19.220", Gateway: "10.192.19.1", Cells: []cellConfig{
+		{Name: "alpha", IPStart: "10.192.19.100", MaxSize: 3},
+	}})
+	c.mux.Unlock()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		rc.mux.Lock()
+		n := len(rc.ads)
+		rc.mux.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the cell to be released, got %v", rc.ads)
+		}
+	}
+	if first := rc.ads[0]; first.State != warden.ClusterAdvertisement_UNAVAILABLE || first.RequestId != "r1" {
+		t.Errorf("Expected the interrupted cell to be unavailable until it is cleaned up, got %v", first)
+	}
+	if last := rc.ads[1]; last.State != warden.ClusterAdvertisement_AVAILABLE || last.RequestId != "" {
+		t.Errorf("Expected the cell to be available again, got %v", last)
+	}
+	if replies := strings.Join(rc.replies, ","); replies != "RESERVE Aborted" {
+		t.Errorf("Expected the reservation to be failed, got %s", replies)
+	}
+	mux.Lock()
+	if len(containers) != 0 {
+		t.Errorf("Expected the containers to be destroyed, got %v", containers)
+	}
+	mux.Unlock()
+	if rez, _ := c.readReservation("alpha"); rez != nil {
+		t.Errorf("Expected the reservation to be removed, got %v", rez)
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"github.com/opennetworkinglab/onos-warden/util"
 	"github.com/opennetworkinglab/onos-warden/warden"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
 	"io"
 	"os"
 	"os/signal"
 	"os/user"
+	"time"
 )
 
 type client struct {
@@ -18,12 +21,12 @@ type client struct {
 	ads    chan *warden.ClusterAdvertisement
 }
 
-func New(addr string) *client {
+func New(addr string, opts ...grpc.DialOption) *client {
 	c := client{
 		ads: make(chan *warden.ClusterAdvertisement),
 	}
 
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	conn, err := grpc.Dial(addr, opts...)
 	if err != nil {
 		grpclog.Fatalf("fail to dial: %v", err)
 	}
@@ -76,20 +79,36 @@ func main() {
 	duration := flag.Int64("duration", -1, "duration of reservation in minutes; -1 is unlimited")
 	nodes := flag.Uint64("nodes", 3, "number of nodes in cell; defaults to 3")
 	addr := flag.String("addr", "127.0.0.1:1234", "address of warden")
+	priority := flag.Int("priority", 0, "priority of reservation while waiting for a cell; higher goes first (admins only)")
+	sessionBound := flag.Bool("sessionBound", false, "release the reservation if this client goes away without returning it")
+	tlsFlags := util.AddTLSFlags()
+	token := util.AddTokenFlag()
+	flag.Parse()
 
 	//Note: Request ids must be unique
 	// ClusterId and ClusterType are optional and we won't be filling those in
 	reqId := *username //TODO just using the username for now
 	baseRequest := warden.ClusterRequest{
-		Duration:  int32(*duration),
-		RequestId: reqId,
+		Duration:     int32(*duration),
+		RequestId:    reqId,
+		Priority:     int32(*priority),
+		SessionBound: *sessionBound,
 		Spec: &warden.ClusterRequest_Spec{
 			ControllerNodes: uint32(*nodes),
 			UserName:        *username,
 			UserKey:         *key,
 		},
 	}
-	c := New(*addr)
+	dialOpt, err := tlsFlags.DialOption()
+	if err != nil {
+		grpclog.Fatalf("failed to load TLS credentials: %v", err)
+	}
+	opts := []grpc.DialOption{dialOpt}
+	if *token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(util.TokenCredentials(*token)))
+	}
+	c := New(*addr, opts...)
+	start := time.Now()
 	c.sendRequest(baseRequest, warden.ClusterRequest_RESERVE)
 
 	intrChan := make(chan os.Signal)
@@ -102,6 +121,29 @@ func main() {
 		case <-intrChan:
 			c.returnClusterAndExit(baseRequest, 0)
 		case ad := <-c.ads:
+			if ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_EXPIRING &&
+				ad.RequestId == baseRequest.RequestId {
+				fmt.Println("Warning:", ad.Event.Message)
+				continue
+			}
+			if ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_PROGRESS &&
+				ad.RequestId == baseRequest.RequestId {
+				fmt.Println(util.FormatProgress(start, ad.Event))
+				continue
+			}
+			if ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_FAILED &&
+				ad.RequestId == baseRequest.RequestId {
+				fmt.Printf("Request failed (%v): %s\n", codes.Code(ad.Event.Code), ad.Event.Message)
+				c.stream.CloseSend()
+				os.Exit(1)
+			}
+			if ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_WITHDRAWN &&
+				ad.RequestId == baseRequest.RequestId {
+				// the warden has already released our cluster; there is nothing to return
+				fmt.Printf("Cluster withdrawn (%v): %s\n", ad.Event.Reason, ad.Event.Message)
+				c.stream.CloseSend()
+				os.Exit(1)
+			}
 			switch ad.State {
 			case warden.ClusterAdvertisement_READY:
 				//TODO ready logic
@@ -124,6 +166,10 @@ func main() {
 
 					}
 				}
+			case warden.ClusterAdvertisement_QUEUED:
+				if baseRequest.RequestId == ad.RequestId {
+					fmt.Println("Waiting for cluster; queue position:", ad.QueuePosition)
+				}
 			default: // warden.ClusterAdvertisement_{UNAVAILABLE, AVAILABLE}
 				if cluster != nil &&
 					cluster.ClusterId == ad.ClusterId &&
@@ -4,8 +4,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"github.com/opennetworkinglab/onos-warden/util"
 	"github.com/opennetworkinglab/onos-warden/warden"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
 	"io"
 	"io/ioutil"
@@ -54,6 +56,8 @@ func sendRequest(req *warden.ClusterRequest,
 		ad, err := client.Request(ctx, req)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Requst failed: %v\n", err)
+		} else if ad.State == warden.ClusterAdvertisement_QUEUED {
+			fmt.Fprintf(os.Stderr, "Request %s is queued at position %d\n", ad.RequestId, ad.QueuePosition)
 		} else {
 			printCell(ad)
 		}
@@ -67,7 +71,7 @@ func listClusters(client warden.ClusterClientServiceClient, ctx context.Context)
 	go func() {
 		stream, err := client.List(ctx, &warden.Empty{})
 		if err != nil {
-			fmt.Fprint(os.Stderr, "Requst failed: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Requst failed: %v\n", err)
 			return
 		}
 
@@ -88,6 +92,72 @@ func listClusters(client warden.ClusterClientServiceClient, ctx context.Context)
 	return
 }
 
+func listAgents(client warden.ClusterClientServiceClient, ctx context.Context) (wait chan struct{}) {
+	wait = make(chan struct{})
+	go func() {
+		defer close(wait)
+		stream, err := client.ListAgents(ctx, &warden.Empty{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Requst failed: %v\n", err)
+			return
+		}
+
+		for {
+			info, err := stream.Recv()
+			if err == io.EOF {
+				// stream closed
+				break
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to receive: %v\n", err)
+				break
+			}
+			reg := info.Registration
+			fmt.Printf("%s\t%s\t%s\t%s\tclusters=%d\tconnected=%s\n", reg.Name, reg.ClusterType, reg.Version,
+				info.Address, info.Clusters, time.Unix(info.ConnectedTime, 0).Format(time.RFC3339))
+		}
+	}()
+	return
+}
+
+func printHistory(client warden.ClusterClientServiceClient, ctx context.Context, q *warden.HistoryQuery) (wait chan struct{}) {
+	wait = make(chan struct{})
+	go func() {
+		defer close(wait)
+		stream, err := client.History(ctx, q)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Requst failed: %v\n", err)
+			return
+		}
+
+		for {
+			rec, err := stream.Recv()
+			if err == io.EOF {
+				// stream closed
+				break
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to receive: %v\n", err)
+				break
+			}
+			what := rec.State.String()
+			if rec.Kind == warden.AuditRecord_REQUEST {
+				what = rec.RequestType.String()
+				if rec.Code != 0 {
+					what += " " + codes.Code(rec.Code).String()
+				}
+			}
+			var held string
+			if rec.HeldSeconds > 0 {
+				held = fmt.Sprintf("held=%v", time.Duration(rec.HeldSeconds)*time.Second)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s/%s\t%s\tduration=%d\t%s\t%s\n", time.Unix(rec.Time, 0).Format(time.RFC3339),
+				rec.Kind, rec.UserName, rec.RequestId, rec.ClusterType, rec.ClusterId, what, rec.Duration, held, rec.Message)
+		}
+	}()
+	return
+}
+
 func main() {
 	currUser, err := user.Current()
 	if err != nil {
@@ -95,16 +165,22 @@ func main() {
 	}
 	defaultKey := fmt.Sprintf("%s/.ssh/id_rsa.pub", currUser.HomeDir)
 
-	username := flag.String("user", currUser.Username, "username for reservation")
+	username := flag.String("user", currUser.Username, "username for reservation, or whose history to show; empty for everyone's")
 	key := flag.String("key", defaultKey, "public key for SSH")
 	duration := flag.Int64("duration", 60, "duration of reservation in minutes")
 	nodes := flag.Uint64("nodes", 3, "number of nodes in cell")
 	addr := flag.String("addr", "127.0.0.1:1234", "address of warden")
 	reqId := flag.String("reqId", currUser.Username, "request id for reservation")
 	timeout := flag.Int64("timeout", -1, "duration in seconds to wait for reply; -1 for indefinitely")
+	priority := flag.Int("priority", 0, "priority of reservation while waiting for a cell; higher goes first (admins only)")
+	cluster := flag.String("cluster", "", "for history, only show records of this cluster")
+	since := flag.Duration("since", 0, "for history, only show records from this long ago; 0 for all")
+	limit := flag.Uint("limit", 0, "for history, only show this many of the most recent records; 0 for all")
+	tlsFlags := util.AddTLSFlags()
+	token := util.AddTokenFlag()
 	flag.Parse()
 	if flag.NArg() == 0 {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] {reserve,status,return}\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] {reserve,status,return,extend,list,agents,history}\n", os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -120,6 +196,7 @@ func main() {
 	req := warden.ClusterRequest{
 		Duration:  int32(*duration),
 		RequestId: *reqId,
+		Priority:  int32(*priority),
 		Spec: &warden.ClusterRequest_Spec{
 			ControllerNodes: uint32(*nodes),
 			UserName:        *username,
@@ -127,7 +204,15 @@ func main() {
 		},
 	}
 
-	conn, err := grpc.Dial(*addr, grpc.WithInsecure())
+	dialOpt, err := tlsFlags.DialOption()
+	if err != nil {
+		grpclog.Fatalf("failed to load TLS credentials: %v", err)
+	}
+	opts := []grpc.DialOption{dialOpt}
+	if *token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(util.TokenCredentials(*token)))
+	}
+	conn, err := grpc.Dial(*addr, opts...)
 	if err != nil {
 		grpclog.Fatalf("fail to dial: %v", err)
 	}
@@ -152,6 +237,14 @@ func main() {
 		waitReq = sendRequest(&req, client, ctx)
 	case "list":
 		waitReq = listClusters(client, ctx)
+	case "agents":
+		waitReq = listAgents(client, ctx)
+	case "history":
+		q := &warden.HistoryQuery{UserName: *username, ClusterId: *cluster, Limit: uint32(*limit)}
+		if *since > 0 {
+			q.Since = time.Now().Add(-*since).Unix()
+		}
+		waitReq = printHistory(client, ctx, q)
 	}
 
 	if waitReq != nil {
@@ -4,8 +4,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"github.com/opennetworkinglab/onos-warden/util"
 	"github.com/opennetworkinglab/onos-warden/warden"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
 	"io"
 	"io/ioutil"
@@ -13,6 +15,7 @@ import (
 	"os/signal"
 	"os/user"
 	"regexp"
+	"time"
 )
 
 type client struct {
@@ -20,12 +23,12 @@ type client struct {
 	ads    chan *warden.ClusterAdvertisement
 }
 
-func New(addr string) *client {
+func New(addr string, opts ...grpc.DialOption) *client {
 	c := client{
 		ads: make(chan *warden.ClusterAdvertisement),
 	}
 
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	conn, err := grpc.Dial(addr, opts...)
 	if err != nil {
 		grpclog.Fatalf("fail to dial: %v", err)
 	}
@@ -68,11 +71,32 @@ func (c *client) waitCluster(baseRequest warden.ClusterRequest) *warden.ClusterA
 	intrChan := make(chan os.Signal)
 	signal.Notify(intrChan, os.Interrupt, os.Kill)
 	var cluster *warden.ClusterAdvertisement
+	start := time.Now()
 	for {
 		select {
 		case <-intrChan:
 			os.Exit(1)
 		case ad := <-c.ads:
+			if ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_EXPIRING &&
+				ad.RequestId == baseRequest.RequestId {
+				fmt.Fprintln(os.Stderr, "Warning:", ad.Event.Message)
+				continue
+			}
+			if ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_PROGRESS &&
+				ad.RequestId == baseRequest.RequestId {
+				fmt.Fprintln(os.Stderr, util.FormatProgress(start, ad.Event))
+				continue
+			}
+			if ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_FAILED &&
+				ad.RequestId == baseRequest.RequestId {
+				fmt.Fprintf(os.Stderr, "Request failed (%v): %s\n", codes.Code(ad.Event.Code), ad.Event.Message)
+				os.Exit(1)
+			}
+			if ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_WITHDRAWN &&
+				ad.RequestId == baseRequest.RequestId {
+				fmt.Fprintf(os.Stderr, "Cluster withdrawn (%v): %s\n", ad.Event.Reason, ad.Event.Message)
+				os.Exit(1)
+			}
 			if match(ad, cluster) {
 				switch ad.State {
 				case warden.ClusterAdvertisement_AVAILABLE:
@@ -85,6 +109,10 @@ func (c *client) waitCluster(baseRequest warden.ClusterRequest) *warden.ClusterA
 			}
 
 			if ad.RequestId == baseRequest.RequestId {
+				if ad.State == warden.ClusterAdvertisement_QUEUED {
+					fmt.Fprintln(os.Stderr, "Waiting for cluster; queue position:", ad.QueuePosition)
+					continue
+				}
 				cluster = ad
 				if ad.State == warden.ClusterAdvertisement_READY {
 					return cluster
@@ -136,6 +164,10 @@ func main() {
 	nodes := flag.Uint64("nodes", 3, "number of nodes in cell")
 	addr := flag.String("addr", "127.0.0.1:1234", "address of warden")
 	reqId := flag.String("reqId", currUser.Username, "request id for reservation")
+	priority := flag.Int("priority", 0, "priority of reservation while waiting for a cell; higher goes first (admins only)")
+	sessionBound := flag.Bool("sessionBound", false, "release the reservation if this client goes away without returning it")
+	tlsFlags := util.AddTLSFlags()
+	token := util.AddTokenFlag()
 	flag.Parse()
 	if flag.NArg() == 0 {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] {reserve,status,return}\n", os.Args[0])
@@ -152,8 +184,10 @@ func main() {
 
 	// ClusterId and ClusterType are optional and we won't be filling those in
 	req := warden.ClusterRequest{
-		Duration:  int32(*duration),
-		RequestId: *reqId,
+		Duration:     int32(*duration),
+		RequestId:    *reqId,
+		Priority:     int32(*priority),
+		SessionBound: *sessionBound,
 		Spec: &warden.ClusterRequest_Spec{
 			ControllerNodes: uint32(*nodes),
 			UserName:        *username,
@@ -161,7 +195,15 @@ func main() {
 		},
 	}
 
-	c := New(*addr)
+	dialOpt, err := tlsFlags.DialOption()
+	if err != nil {
+		grpclog.Fatalf("failed to load TLS credentials: %v", err)
+	}
+	opts := []grpc.DialOption{dialOpt}
+	if *token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(util.TokenCredentials(*token)))
+	}
+	c := New(*addr, opts...)
 	defer c.stream.CloseSend()
 	switch op {
 	case "reserve":
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc/codes"
+	"time"
+)
+
+// A request forwarded to an agent that has not acknowledged it yet
+type pendingAck struct {
+	agent *agentConn
+	k     key
+	req   *warden.ClusterRequest
+	timer *time.Timer
+}
+
+// Returns true if the registered agent acknowledges the requests it is sent
+func acknowledges(reg *warden.AgentRegistration) bool {
+	for _, c := range reg.Capabilities {
+		if c == "ack" {
+			return true
+		}
+	}
+	return false
+}
+
+// Fails the request unless the agent acknowledges it within the ack timeout; every registered
+// agent acknowledges the requests it is sent
+func (s *wardenServer) awaitAck(cl *cluster, req *warden.ClusterRequest) {
+	// Note: callers must hold s.lock
+	if s.ackTimeout <= 0 {
+		return
+	}
+	rId := req.RequestId
+	s.cancelAck(rId)
+	p := &pendingAck{agent: cl.agent, k: keyFromCluster(cl), req: req}
+	p.timer = time.AfterFunc(s.ackTimeout, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.pendingAcks[rId] == p {
+			delete(s.pendingAcks, rId)
+			s.ackTimedOut(p)
+		}
+	})
+	s.pendingAcks[rId] = p
+}
+
+func (s *wardenServer) cancelAck(rId string) {
+	// Note: callers must hold s.lock
+	if p, ok := s.pendingAcks[rId]; ok {
+		p.timer.Stop()
+		delete(s.pendingAcks, rId)
+	}
+}
+
+func (s *wardenServer) ackTimedOut(p *pendingAck) {
+	// Note: callers must hold s.lock
+	msg := fmt.Sprintf("Agent %s did not acknowledge %v request %s within %v", p.agent.reg.Name, p.req.Type, p.req.RequestId, s.ackTimeout)
+	fmt.Println(msg)
+	s.requestFailed(p.agent, &warden.RequestAck{
+		RequestId:   p.req.RequestId,
+		ClusterId:   p.k.cId,
+		ClusterType: p.k.cType,
+		Type:        p.req.Type,
+		Phase:       warden.RequestAck_REJECTED,
+		Code:        uint32(codes.DeadlineExceeded),
+		Message:     msg,
+	})
+}
+
+// Tells clients that the reservation was returned, if its return is awaiting the agent
+func (s *wardenServer) withdrawReturned(rId string) {
+	// Note: callers must hold s.lock
+	k, ok := s.returns[rId]
+	if !ok {
+		return
+	}
+	delete(s.returns, rId)
+	if cl, ok := s.clusters[k]; ok {
+		s.sendWithdrawal(cl.ad, warden.ClusterAdvertisement_Event_RETURNED, "reservation was returned")
+	}
+}
+
+func (s *wardenServer) handleAck(agent *agentConn, ack *warden.RequestAck) {
+	// Note: callers must hold s.lock
+	if p, ok := s.pendingAcks[ack.RequestId]; ok && p.agent == agent {
+		s.cancelAck(ack.RequestId)
+	}
+	switch ack.Phase {
+	case warden.RequestAck_REJECTED, warden.RequestAck_FAILED:
+		s.requestFailed(agent, ack)
+	case warden.RequestAck_ACCEPTED, warden.RequestAck_COMPLETED:
+		if ack.Type == warden.ClusterRequest_RETURN {
+			if k, ok := s.returns[ack.RequestId]; ok && s.clusters[k].agent == agent {
+				s.withdrawReturned(ack.RequestId)
+			}
+		}
+		if ack.Phase == warden.RequestAck_COMPLETED {
+			// the request was carried out, so its charge stands
+			delete(s.charges, ack.RequestId)
+		}
+	case warden.RequestAck_PROGRESS:
+		k, ok := s.requests[ack.RequestId]
+		if !ok {
+			return
+		}
+		cl, ok := s.clusters[k]
+		if !ok || cl.agent != agent {
+			return
+		}
+		// Send a copy, so that the event is not retained in the cluster's advertisement
+		ad := *cl.ad
+		ad.Event = &warden.ClusterAdvertisement_Event{
+			Type:    warden.ClusterAdvertisement_Event_PROGRESS,
+			Message: ack.Message,
+			Step:    ack.Step,
+			Steps:   ack.Steps,
+		}
+		s.sendUpdate(&ad)
+	}
+}
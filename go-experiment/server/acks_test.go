@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"testing"
+	"time"
+)
+
+func TestAckTimeout(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	s.ackTimeout = 10 * time.Millisecond
+	agent := &agentConn{reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy", Capabilities: []string{"ack"}}}
+
+	ad := &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy",
+		State: warden.ClusterAdvertisement_RESERVED, RequestId: "tom"}
+	cl := &cluster{ad: ad, agent: agent}
+	k := keyFromCluster(cl)
+	req := &warden.ClusterRequest{RequestId: "tom", Type: warden.ClusterRequest_RESERVE}
+
+	s.lock.Lock()
+	s.clusters[k] = *cl
+	s.requests["tom"] = k
+	wait := s.waitForReady(cl, "tom")
+	s.awaitAck(cl, req)
+	s.lock.Unlock()
+
+	select {
+	case reply := <-wait:
+		if err := replyError("tom", reply); grpc.Code(err) != codes.DeadlineExceeded {
+			t.Errorf("Expected DeadlineExceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Waiter was not failed after the ack timeout")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c := s.clusters[k]; c.ad.State != warden.ClusterAdvertisement_AVAILABLE || c.ad.RequestId != "" {
+		t.Errorf("Expected the reservation to be released, got %v", c.ad)
+	}
+	if _, ok := s.requests["tom"]; ok {
+		t.Error("Expected the request mapping to be removed")
+	}
+
+	// acknowledged requests are not failed
+	s.awaitAck(cl, req)
+	s.handleAck(agent, &warden.RequestAck{RequestId: "tom", Phase: warden.RequestAck_ACCEPTED})
+	if _, ok := s.pendingAcks["tom"]; ok {
+		t.Error("Expected the ack to clear the pending request")
+	}
+}
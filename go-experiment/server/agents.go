@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"time"
+)
+
+// Connection to a registered agent
+type agentConn struct {
+	stream    warden.ClusterAgentService_AgentClustersServer
+	reg       *warden.AgentRegistration
+	connected time.Time
+}
+
+func (a *agentConn) Send(req *warden.ClusterRequest) error {
+	return a.stream.Send(req)
+}
+
+func (a *agentConn) Context() context.Context {
+	return a.stream.Context()
+}
+
+func (a *agentConn) String() string {
+	return fmt.Sprintf("%s (%s, version %s)", a.reg.Name, a.reg.ClusterType, a.reg.Version)
+}
+
+// Waits for the agent's registration and adds it to the registry of connected agents, replacing any
+// earlier connection of an agent of the same name
+func (s *wardenServer) registerAgent(stream warden.ClusterAgentService_AgentClustersServer) (*agentConn, error) {
+	msg, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	reg := msg.Registration
+	if reg == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "agents must register before advertising clusters")
+	}
+	if reg.Name == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "agent registration is missing a name")
+	}
+	if !acknowledges(reg) {
+		// requests would otherwise hang when such an agent drops them
+		return nil, grpc.Errorf(codes.FailedPrecondition, "agent %s must acknowledge requests (the \"ack\" capability)", reg.Name)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if existing, ok := s.agents[reg.Name]; ok {
+		// the old stream may be half-open, e.g. after the agent's network dropped, and linger until
+		// it times out; treat the agent as having disconnected, and carry on with the new stream
+		logAgent(stream.Context(), "Replacing connection of agent "+existing.String()+" with new one from", nil)
+		s.disconnectAgent(existing)
+	}
+	a := &agentConn{stream, reg, time.Now()}
+	s.agents[reg.Name] = a
+	return a, nil
+}
+
+// Returns an error if the agent may not advertise the cluster
+func (a *agentConn) checkAdvertisement(ad *warden.ClusterAdvertisement) error {
+	if a.reg.ClusterType != "" && a.reg.ClusterType != ad.ClusterType {
+		return fmt.Errorf("agent %s cannot advertise %s cluster %s", a.reg.Name, ad.ClusterType, ad.ClusterId)
+	}
+	return nil
+}
+
+func (s *wardenServer) ListAgents(_ *warden.Empty, stream warden.ClusterClientService_ListAgentsServer) error {
+	logClient(stream.Context(), "List agents from", nil)
+	id, err := s.identify(stream.Context())
+	if err != nil {
+		return err
+	}
+	if !id.admin {
+		return grpc.Errorf(codes.PermissionDenied, "%s is not an admin", id.user)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, a := range s.agents {
+		info := &warden.AgentInfo{
+			Registration:  a.reg,
+			ConnectedTime: a.connected.Unix(),
+		}
+		if p, ok := peer.FromContext(a.Context()); ok {
+			info.Address = p.Addr.String()
+		}
+		for _, cl := range s.clusters {
+			if cl.agent == a {
+				info.Clusters++
+			}
+		}
+		if err := stream.Send(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if the agent hosting the cluster has disconnected and not yet come back
+func (cl *cluster) stale() bool {
+	return !cl.staleSince.IsZero()
+}
+
+func (s *wardenServer) disconnectAgent(agent *agentConn) {
+	// Note: callers must hold s.lock
+	if s.agentGrace <= 0 {
+		s.dropClusters(agent)
+		return
+	}
+
+	// Keep the clusters and their reservations for the grace period, in case the agent reconnects
+	now := time.Now()
+	for k, cl := range s.clusters {
+		if cl.agent == agent {
+			cl.staleSince = now
+			s.clusters[k] = cl
+			fmt.Printf("Agent %s for cluster %s disconnected; waiting %v for it to return\n",
+				agent, cl.ad.ClusterId, s.agentGrace)
+		}
+	}
+	time.AfterFunc(s.agentGrace, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.dropClusters(agent)
+	})
+}
+
+// Removes the clusters that are still hosted by the given agent
+func (s *wardenServer) dropClusters(agent *agentConn) {
+	// Note: callers must hold s.lock
+	for _, cl := range s.clusters {
+		if cl.agent == agent {
+			s.deleteCluster(&cl, warden.ClusterAdvertisement_Event_AGENT_LOST)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"testing"
+	"time"
+)
+
+// Agent stream that registers the agent as its first message
+type registeringAgentStream struct {
+	sendingAgentStream
+	reg *warden.AgentRegistration
+}
+
+func (s *registeringAgentStream) Recv() (*warden.AgentMessage, error) {
+	return &warden.AgentMessage{Registration: s.reg}, nil
+}
+
+func TestReregisterAgent(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	s.agentGrace = time.Hour
+	reg := &warden.AgentRegistration{Name: "a", ClusterType: "dummy", Capabilities: []string{"ack"}}
+	if _, err := s.registerAgent(&registeringAgentStream{reg: &warden.AgentRegistration{Name: "b"}}); grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected an agent that does not acknowledge requests to be refused, got %v", err)
+	}
+	old, err := s.registerAgent(&registeringAgentStream{reg: reg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := key{"a", "dummy"}
+	s.clusters[k] = cluster{agent: old, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}}
+
+	// the agent comes back before its old stream is known to be dead
+	agent, err := s.registerAgent(&registeringAgentStream{reg: reg})
+	if err != nil {
+		t.Fatalf("Expected the agent to register again, got %v", err)
+	}
+	if s.agents["a"] != agent {
+		t.Error("Expected the new connection to replace the old one")
+	}
+	if !s.clusters[k].stale() {
+		t.Error("Expected the clusters of the old connection to wait for the agent to re-advertise them")
+	}
+
+	s.updateCluster(&cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}})
+	if cl := s.clusters[k]; cl.stale() || cl.agent != agent {
+		t.Errorf("Expected the cluster to be hosted by the new connection, got %v", cl)
+	}
+}
+
+func TestRemoveCluster(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	agent := &agentConn{stream: &sendingAgentStream{}, reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	other := &agentConn{stream: &sendingAgentStream{}, reg: &warden.AgentRegistration{Name: "b", ClusterType: "dummy"}}
+	k := key{"a", "dummy"}
+	s.clusters[k] = cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_RESERVED, RequestId: "tom"}}
+	s.requests["tom"] = k
+	s.owners["tom"] = "tom"
+	tom := s.waitForReady(&cluster{ad: s.clusters[k].ad}, "tom")
+
+	// only the agent hosting the cluster can withdraw it
+	s.removeCluster(other, k)
+	if _, ok := s.clusters[k]; !ok {
+		t.Fatal("Expected the withdrawal of another agent to be ignored")
+	}
+
+	s.removeCluster(agent, k)
+	if _, ok := s.clusters[k]; ok {
+		t.Error("Expected the cluster to be removed")
+	}
+	if _, ok := s.requests["tom"]; ok {
+		t.Error("Expected the request of the removed cluster to be forgotten")
+	}
+	select {
+	case ad := <-tom:
+		if err := replyError("tom", ad); grpc.Code(err) != codes.Unavailable {
+			t.Errorf("Expected tom's request to fail, got %v", err)
+		}
+	default:
+		t.Error("Expected tom's waiter to be failed")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"os"
+	"sync"
+	"time"
+)
+
+// Append-only record of the requests made of the server and of the clusters' state transitions
+type auditLog interface {
+	Append(rec *warden.AuditRecord) error
+	// Returns the records matching the query, oldest first
+	Query(q *warden.HistoryQuery) ([]*warden.AuditRecord, error)
+	Close() error
+}
+
+// Audit log that keeps nothing; used when auditing is disabled
+type nopAudit struct{}
+
+func (nopAudit) Append(rec *warden.AuditRecord) error {
+	return nil
+}
+
+func (nopAudit) Query(q *warden.HistoryQuery) ([]*warden.AuditRecord, error) {
+	return nil, nil
+}
+
+func (nopAudit) Close() error {
+	return nil
+}
+
+// Audit log kept in a local file, one JSON record per line; unlike the state journal, it is
+// never compacted
+type fileAudit struct {
+	// guards the file, since queries are served without holding the server's lock
+	lock sync.Mutex
+	path string
+	f    *os.File
+}
+
+// Opens (or creates) the audit log at the given path; an empty path disables auditing
+func newAuditLog(path string) (auditLog, error) {
+	if path == "" {
+		return nopAudit{}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAudit{path: path, f: f}, nil
+}
+
+func (a *fileAudit) Append(rec *warden.AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.f == nil {
+		return fmt.Errorf("audit log %s is not open", a.path)
+	}
+	_, err = a.f.Write(append(b, '\n'))
+	return err
+}
+
+func (a *fileAudit) Query(q *warden.HistoryQuery) ([]*warden.AuditRecord, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []*warden.AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		rec := new(warden.AuditRecord)
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			fmt.Printf("Skipping bad audit record %s:%d: %v\n", a.path, line, err)
+			continue
+		}
+		if !queryMatches(q, rec) {
+			continue
+		}
+		recs = append(recs, rec)
+		if q.Limit > 0 && len(recs) > int(2*q.Limit) {
+			// keep only the most recent records, without copying on every append
+			recs = append(recs[:0], recs[len(recs)-int(q.Limit):]...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if q.Limit > 0 && len(recs) > int(q.Limit) {
+		recs = recs[len(recs)-int(q.Limit):]
+	}
+	return recs, nil
+}
+
+func (a *fileAudit) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+func queryMatches(q *warden.HistoryQuery, rec *warden.AuditRecord) bool {
+	return (q.UserName == "" || q.UserName == rec.UserName) &&
+		(q.ClusterId == "" || q.ClusterId == rec.ClusterId) &&
+		(q.ClusterType == "" || q.ClusterType == rec.ClusterType) &&
+		(q.Since == 0 || rec.Time >= q.Since) &&
+		(q.Until == 0 || rec.Time <= q.Until)
+}
+
+func (s *wardenServer) audit(rec *warden.AuditRecord) {
+	rec.Time = time.Now().Unix()
+	if err := s.auditLog.Append(rec); err != nil {
+		fmt.Printf("Failed to audit %v: %v\n", rec, err)
+	}
+}
+
+// Records a request made by the given user and the server's immediate response to it
+func (s *wardenServer) auditRequest(id identity, req *warden.ClusterRequest, err error) {
+	// Note: callers must hold s.lock
+	user := id.user
+	if user == "" && req.Spec != nil {
+		user = req.Spec.UserName
+	}
+	if user == "" {
+		user, _ = s.requestOwner(req.RequestId)
+	}
+	rec := &warden.AuditRecord{
+		Kind:        warden.AuditRecord_REQUEST,
+		UserName:    user,
+		RequestId:   req.RequestId,
+		ClusterId:   req.ClusterId,
+		ClusterType: req.ClusterType,
+		RequestType: req.Type,
+		Duration:    req.Duration,
+		Code:        uint32(grpc.Code(err)),
+	}
+	if err != nil {
+		rec.Message = grpc.ErrorDesc(err)
+	}
+	s.audit(rec)
+}
+
+// Records the failure of a request reported by an agent, or of its acknowledgement
+func (s *wardenServer) auditFailure(f *warden.RequestAck, user string) {
+	s.audit(&warden.AuditRecord{
+		Kind:        warden.AuditRecord_REQUEST,
+		UserName:    user,
+		RequestId:   f.RequestId,
+		ClusterId:   f.ClusterId,
+		ClusterType: f.ClusterType,
+		RequestType: f.Type,
+		Code:        f.Code,
+		Message:     f.Message,
+	})
+}
+
+// Records the transition of a cluster from its previous advertisement, if any, to the next one;
+// advertisements that change neither its state nor its request are not recorded
+func (s *wardenServer) auditTransition(k key, prev, next *warden.ClusterAdvertisement, msg string) {
+	if prev != nil && next != nil && prev.State == next.State && prev.RequestId == next.RequestId {
+		return
+	}
+	rec := &warden.AuditRecord{
+		Kind:        warden.AuditRecord_TRANSITION,
+		ClusterId:   k.cId,
+		ClusterType: k.cType,
+		State:       warden.ClusterAdvertisement_UNAVAILABLE,
+		Message:     msg,
+	}
+	if next != nil {
+		rec.RequestId = next.RequestId
+		rec.State = next.State
+		if info := next.ReservationInfo; info != nil {
+			rec.UserName = info.UserName
+			rec.Duration = info.Duration
+		}
+	}
+	if prev != nil && prev.ReservationInfo != nil {
+		// the reservation ends unless the next advertisement carries it on
+		info := prev.ReservationInfo
+		if next == nil || next.ReservationInfo == nil || next.ReservationInfo.ReservationStartTime != info.ReservationStartTime {
+			rec.UserName = info.UserName
+			rec.RequestId = prev.RequestId
+			rec.Duration = info.Duration
+			rec.HeldSeconds = time.Now().Unix() - info.ReservationStartTime
+			if rec.Message == "" {
+				rec.Message = "reservation ended"
+			}
+		}
+	}
+	s.audit(rec)
+}
+
+// Returns the audit records that match the query; users other than admins may only see their own
+func (s *wardenServer) History(q *warden.HistoryQuery, stream warden.ClusterClientService_HistoryServer) error {
+	logClient(stream.Context(), "History from", q)
+	id, err := s.identify(stream.Context())
+	if err != nil {
+		return err
+	}
+	if s.userAuth && !id.admin {
+		if q.UserName == "" {
+			q.UserName = id.user
+		} else if q.UserName != id.user {
+			return grpc.Errorf(codes.PermissionDenied, "%s may not query the history of %s", id.user, q.UserName)
+		}
+	}
+
+	recs, err := s.auditLog.Query(q)
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Failed to read audit log: %v", err)
+	}
+	for _, rec := range recs {
+		if err := stream.Send(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	audit, err := newAuditLog(filepath.Join(dir, "warden.audit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	s := newServer(nopStore{}, nil)
+	s.auditLog = audit
+
+	k := key{"a", "dummy"}
+	start := time.Now().Add(-time.Hour).Unix()
+	available := &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}
+	ready := &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_READY,
+		RequestId: "tom", ReservationInfo: &warden.ClusterAdvertisement_ReservationInfo{UserName: "tom", Duration: 120, ReservationStartTime: start}}
+
+	s.auditRequest(identity{}, &warden.ClusterRequest{RequestId: "tom", Type: warden.ClusterRequest_RESERVE,
+		Spec: &warden.ClusterRequest_Spec{UserName: "tom"}}, nil)
+	s.auditTransition(k, nil, ready, "")
+	s.auditTransition(k, ready, ready, "")
+	s.auditTransition(k, ready, available, "")
+	s.auditRequest(identity{user: "ann"}, &warden.ClusterRequest{RequestId: "ann", Type: warden.ClusterRequest_RESERVE}, nil)
+
+	recs, err := audit.Query(&warden.HistoryQuery{UserName: "tom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("Expected 3 records for tom, got %v", recs)
+	}
+	if recs[0].Kind != warden.AuditRecord_REQUEST || recs[1].State != warden.ClusterAdvertisement_READY {
+		t.Errorf("Unexpected records %v", recs)
+	}
+	if end := recs[2]; end.State != warden.ClusterAdvertisement_AVAILABLE || end.HeldSeconds < 3600 || end.RequestId != "tom" {
+		t.Errorf("Expected the end of the reservation with its held time, got %v", end)
+	}
+
+	recs, err = audit.Query(&warden.HistoryQuery{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].UserName != "ann" {
+		t.Errorf("Expected only the most recent record, got %v", recs)
+	}
+	recs, err = audit.Query(&warden.HistoryQuery{ClusterId: "a", Until: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 0 {
+		t.Errorf("Expected no records before the reservation started, got %v", recs)
+	}
+}
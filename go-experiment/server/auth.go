@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/util"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"os"
+	"strings"
+)
+
+// Returns the verified TLS certificate chain of the peer, if it presented one
+func verifiedChain(ctx context.Context) (credentials.TLSInfo, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return credentials.TLSInfo{}, false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return credentials.TLSInfo{}, false
+	}
+	return info, true
+}
+
+// Returns true if the peer's certificate chains to one of the CAs in the pool; the TLS handshake
+// verifies client certificates against the CAs of users and agents alike, so that callers must
+// check which of them issued it
+func verifiedBy(info credentials.TLSInfo, pool *x509.CertPool) bool {
+	certs := info.State.PeerCertificates
+	if pool == nil || len(certs) == 0 {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// Returns an error unless the agent presented a certificate signed by the agents' CA, which does
+// not sign the certificates of users; agents are not checked when the server is running without
+// TLS
+func (s *wardenServer) authorizeAgent(ctx context.Context) error {
+	if s.agentCAs == nil {
+		return nil
+	}
+	if info, ok := verifiedChain(ctx); !ok || !verifiedBy(info, s.agentCAs) {
+		return grpc.Errorf(codes.Unauthenticated, "agents must present a certificate issued by the agent CA")
+	}
+	return nil
+}
+
+// Identity of the user behind a client request
+type identity struct {
+	user  string
+	admin bool
+}
+
+// Reads the token file; each line holds a user name and their token, separated by whitespace
+func loadTokens(path string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	if path == "" {
+		return tokens, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<user> <token>\"", path, line)
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	return tokens, scanner.Err()
+}
+
+// Returns the identity of the client, taken from its verified certificate or its bearer token;
+// when user authentication is disabled, every client is trusted as an admin
+func (s *wardenServer) identify(ctx context.Context) (identity, error) {
+	if !s.userAuth {
+		return identity{admin: true}, nil
+	}
+	var user string
+	if info, ok := verifiedChain(ctx); ok {
+		user = s.certUser(info.State)
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && user == "" {
+		for _, v := range md[util.TokenHeader] {
+			if u := s.tokenUser(v); u != "" {
+				user = u
+			}
+		}
+	}
+	return s.identityOf(user)
+}
+
+// Returns the user named by the client certificate of the connection, unless it is missing or was not
+// issued by the users' CA; agents' certificates pass the TLS handshake too, but do not identify users
+func (s *wardenServer) certUser(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || !verifiedBy(credentials.TLSInfo{State: state}, s.userCAs) {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// Returns the user holding the bearer token in the authorization header value, if it is known
+func (s *wardenServer) tokenUser(header string) string {
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return s.tokens[strings.TrimPrefix(header, "Bearer ")]
+}
+
+func (s *wardenServer) identityOf(user string) (identity, error) {
+	if user == "" {
+		return identity{}, grpc.Errorf(codes.Unauthenticated, "clients must present a valid certificate or token")
+	}
+	return identity{user, s.admins[user]}, nil
+}
+
+// Returns the name of the user holding the given request, if it is known
+func (s *wardenServer) requestOwner(rId string) (string, bool) {
+	// Note: callers must hold s.lock
+	if i := s.queue.find(rId); i >= 0 {
+		if spec := s.queue.entries[i].req.Spec; spec != nil {
+			return spec.UserName, true
+		}
+		return "", true
+	}
+	k, ok := s.requests[rId]
+	if !ok {
+		return "", false
+	}
+	var ad *warden.ClusterAdvertisement
+	if cl, ok := s.clusters[k]; ok {
+		ad = cl.ad
+	} else if ad, ok = s.restored[k]; !ok {
+		return "", false
+	}
+	if ad.ReservationInfo == nil {
+		// the cluster is only marked as reserved until its agent advertises the reservation
+		owner, ok := s.owners[rId]
+		return owner, ok
+	}
+	return ad.ReservationInfo.UserName, true
+}
+
+// Returns an error unless the user may make the request; reservations are made in the user's
+// name and only the owner of a reservation (or an admin) may return, extend or query it; only admins
+// may queue requests with a priority
+func (s *wardenServer) authorizeRequest(id identity, req *warden.ClusterRequest) error {
+	// Note: callers must hold s.lock
+	if req.Type == warden.ClusterRequest_RESERVE && id.user != "" {
+		if req.Spec == nil {
+			req.Spec = &warden.ClusterRequest_Spec{}
+		}
+		if req.Spec.UserName == "" {
+			req.Spec.UserName = id.user
+		}
+		if req.Spec.UserName != id.user && !id.admin {
+			return grpc.Errorf(codes.PermissionDenied, "%s cannot reserve a cluster for %s",
+				id.user, req.Spec.UserName)
+		}
+	}
+	if req.Type == warden.ClusterRequest_RESERVE && req.Priority != 0 && !id.admin {
+		// otherwise anyone could jump the queue
+		return grpc.Errorf(codes.PermissionDenied, "%s cannot set the priority of request %s",
+			id.user, req.RequestId)
+	}
+	if id.admin {
+		return nil
+	}
+	if owner, ok := s.requestOwner(req.RequestId); ok && owner != id.user {
+		return grpc.Errorf(codes.PermissionDenied, "request %s belongs to %s, not %s",
+			req.RequestId, owner, id.user)
+	}
+	return nil
+}
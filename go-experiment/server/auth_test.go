@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Certificate and key of a test CA
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Returns a context whose peer presented a client certificate for the name, issued by the CA and
+// verified by the TLS handshake
+func (ca *testCA) peerContext(t *testing.T, name string) context.Context {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert, ca.cert}},
+	}
+	return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+}
+
+// Agent stream that only carries its context
+type contextAgentStream struct {
+	warden.ClusterAgentService_AgentClustersServer
+	ctx context.Context
+}
+
+func (s contextAgentStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestAgentCertificates(t *testing.T) {
+	agentCA, userCA := newTestCA(t, "agents"), newTestCA(t, "users")
+	s := newServer(nopStore{}, nil)
+	s.agentCAs, s.userCAs = agentCA.pool(), userCA.pool()
+	s.userAuth = true
+
+	// a user's certificate is verified by the handshake, but does not make its holder an agent
+	userCtx := userCA.peerContext(t, "tom")
+	err := s.AgentClusters(contextAgentStream{ctx: userCtx})
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected user certificate to be rejected, got %v", err)
+	}
+	if id, err := s.identify(userCtx); err != nil || id.user != "tom" {
+		t.Errorf("Expected user tom, got %v (%v)", id, err)
+	}
+
+	agentCtx := agentCA.peerContext(t, "lxc-agent")
+	if err := s.authorizeAgent(agentCtx); err != nil {
+		t.Errorf("Expected agent certificate to be accepted, got %v", err)
+	}
+	// nor does an agent's certificate identify a user
+	if id, err := s.identify(agentCtx); grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected agent certificate not to identify a user, got %v (%v)", id, err)
+	}
+	if err := s.authorizeAgent(context.Background()); grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected agent without certificate to be rejected, got %v", err)
+	}
+
+	// the same holds for the HTTP gateway, where an agent named after an admin gains nothing
+	s.admins["lxc-agent"] = true
+	httpRequest := func(ctx context.Context) *http.Request {
+		p, _ := peer.FromContext(ctx)
+		state := p.AuthInfo.(credentials.TLSInfo).State
+		r := httptest.NewRequest(http.MethodGet, "/api/whoami", nil)
+		r.TLS = &state
+		return r
+	}
+	if id, err := s.identifyHTTP(httpRequest(userCtx)); err != nil || id.user != "tom" {
+		t.Errorf("Expected user tom over HTTP, got %v (%v)", id, err)
+	}
+	if id, err := s.identifyHTTP(httpRequest(agentCtx)); grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected agent certificate not to identify a user over HTTP, got %v (%v)", id, err)
+	}
+}
+
+func TestRequestOwner(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	stream := &sendingAgentStream{}
+	agent := &agentConn{stream: stream, reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	s.clusters[key{"a", "dummy"}] = cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}}
+
+	reserve := &warden.ClusterRequest{RequestId: "r1", Type: warden.ClusterRequest_RESERVE, Duration: 60}
+	if _, err := s.processRequest(identity{user: "tom"}, reserve, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the cluster is marked as reserved, but the agent has yet to advertise the reservation
+	ret := &warden.ClusterRequest{RequestId: "r1", Type: warden.ClusterRequest_RETURN}
+	if _, err := s.processRequest(identity{user: "ann"}, ret, nil); grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected ann's return of tom's reservation to be denied, got %v", err)
+	}
+	if _, err := s.processRequest(identity{user: "tom"}, ret, nil); err != nil {
+		t.Errorf("Expected tom to return the reservation, got %v", err)
+	}
+	if len(stream.sent) != 2 || stream.sent[1].Type != warden.ClusterRequest_RETURN {
+		t.Errorf("Expected the reserve and tom's return to be forwarded, got %v", stream.sent)
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	req := &warden.ClusterRequest{RequestId: "r1", Type: warden.ClusterRequest_RESERVE, Priority: 1}
+	if err := s.authorizeRequest(identity{user: "tom"}, req); grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected tom's priority request to be denied, got %v", err)
+	}
+	if err := s.authorizeRequest(identity{user: "ann", admin: true}, req); err != nil {
+		t.Errorf("Expected an admin to set the priority, got %v", err)
+	}
+	req = &warden.ClusterRequest{RequestId: "r2", Type: warden.ClusterRequest_RESERVE}
+	if err := s.authorizeRequest(identity{user: "tom"}, req); err != nil {
+		t.Errorf("Expected tom's request without priority to be allowed, got %v", err)
+	}
+}
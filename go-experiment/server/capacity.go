@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Returns true if the cluster matches the requested cluster type and id
+func matches(req *warden.ClusterRequest, ad *warden.ClusterAdvertisement) bool {
+	if req.ClusterType != "" && req.ClusterType != ad.ClusterType {
+		return false
+	}
+	if req.ClusterId != "" && req.ClusterId != ad.ClusterId {
+		return false
+	}
+	return true
+}
+
+// Returns true if the advertised capacity of the cluster can satisfy the request's spec;
+// clusters that do not advertise capacity are assumed to fit any spec
+func fits(req *warden.ClusterRequest, ad *warden.ClusterAdvertisement) bool {
+	c := ad.Capacity
+	if c == nil || req.Spec == nil {
+		return true
+	}
+	if req.Spec.ControllerNodes > c.MaxControllerNodes {
+		return false
+	}
+	for _, f := range req.Spec.Features {
+		found := false
+		for _, cf := range c.Features {
+			if f == cf {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if cluster a is a better fit for the request than cluster b; the best fit
+// is the smallest cluster that can hold the requested controller nodes
+func betterFit(a, b *warden.ClusterAdvertisement) bool {
+	ca, cb := a.Capacity, b.Capacity
+	if ca == nil || cb == nil {
+		// prefer clusters with known capacity
+		if (ca == nil) != (cb == nil) {
+			return cb == nil
+		}
+	} else {
+		if ca.MaxControllerNodes != cb.MaxControllerNodes {
+			return ca.MaxControllerNodes < cb.MaxControllerNodes
+		}
+		if ca.Cpus != cb.Cpus {
+			return ca.Cpus < cb.Cpus
+		}
+		if ca.MemoryMb != cb.MemoryMb {
+			return ca.MemoryMb < cb.MemoryMb
+		}
+		if len(ca.Features) != len(cb.Features) {
+			return len(ca.Features) < len(cb.Features)
+		}
+	}
+	// break ties deterministically
+	if a.ClusterType != b.ClusterType {
+		return a.ClusterType < b.ClusterType
+	}
+	return a.ClusterId < b.ClusterId
+}
+
+// Returns an error if no known cluster could ever satisfy the request, regardless of its state
+func (s *wardenServer) checkSatisfiable(req *warden.ClusterRequest) error {
+	// Note: callers must hold s.lock
+	known, tooLong := false, false
+	var largest uint32
+	for _, c := range s.clusters {
+		if !matches(req, c.ad) {
+			continue
+		}
+		known = true
+		if fits(req, c.ad) {
+			if s.policy.allowsDuration(c.ad.ClusterType, req.Duration) {
+				return nil
+			}
+			tooLong = true
+		}
+		if c.ad.Capacity != nil && c.ad.Capacity.MaxControllerNodes > largest {
+			largest = c.ad.Capacity.MaxControllerNodes
+		}
+	}
+	for k := range s.restored {
+		if (req.ClusterType == "" || req.ClusterType == k.cType) && (req.ClusterId == "" || req.ClusterId == k.cId) {
+			// capacity is unknown until the agent reconnects; let the request wait
+			return nil
+		}
+	}
+	if !known {
+		return grpc.Errorf(codes.Unavailable, "No clusters matching type %q and id %q are advertised",
+			req.ClusterType, req.ClusterId)
+	}
+	if tooLong {
+		return grpc.Errorf(codes.InvalidArgument, "Duration %d of req %s exceeds the limit for every cluster that fits it",
+			req.Duration, req.RequestId)
+	}
+	return grpc.Errorf(codes.FailedPrecondition,
+		"No cluster can satisfy req %s for %d controller nodes with features %v (largest fits %d nodes)",
+		req.RequestId, req.Spec.ControllerNodes, req.Spec.Features, largest)
+}
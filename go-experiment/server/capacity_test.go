@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"testing"
+)
+
+func capacityAd(cId string, nodes uint32, features ...string) *warden.ClusterAdvertisement {
+	return &warden.ClusterAdvertisement{ClusterId: cId, ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE,
+		Capacity: &warden.ClusterAdvertisement_Capacity{MaxControllerNodes: nodes, Features: features}}
+}
+
+func specRequest(nodes uint32, features ...string) *warden.ClusterRequest {
+	return &warden.ClusterRequest{RequestId: "tom", Type: warden.ClusterRequest_RESERVE, Duration: 60,
+		Spec: &warden.ClusterRequest_Spec{ControllerNodes: nodes, Features: features}}
+}
+
+func TestMatchesAndFits(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		req     *warden.ClusterRequest
+		ad      *warden.ClusterAdvertisement
+		matches bool
+		fits    bool
+	}{
+		{"any cluster", &warden.ClusterRequest{}, capacityAd("a", 3), true, true},
+		{"other type", &warden.ClusterRequest{ClusterType: "ec2"}, capacityAd("a", 3), false, true},
+		{"other id", &warden.ClusterRequest{ClusterId: "b"}, capacityAd("a", 3), false, true},
+		{"same type and id", &warden.ClusterRequest{ClusterType: "dummy", ClusterId: "a"}, capacityAd("a", 3), true, true},
+		{"unknown capacity", specRequest(7, "mininet"), &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy"}, true, true},
+		{"as many nodes", specRequest(3), capacityAd("a", 3), true, true},
+		{"too many nodes", specRequest(5), capacityAd("a", 3), true, false},
+		{"supported features", specRequest(1, "mininet", "p4"), capacityAd("a", 3, "p4", "mininet"), true, true},
+		{"missing feature", specRequest(1, "mininet", "p4"), capacityAd("a", 3, "mininet"), true, false},
+	} {
+		if m := matches(c.req, c.ad); m != c.matches {
+			t.Errorf("%s: expected matches %v, got %v", c.name, c.matches, m)
+		}
+		if f := fits(c.req, c.ad); f != c.fits {
+			t.Errorf("%s: expected fits %v, got %v", c.name, c.fits, f)
+		}
+	}
+}
+
+func TestBetterFit(t *testing.T) {
+	unknown := &warden.ClusterAdvertisement{ClusterId: "u", ClusterType: "dummy"}
+	for _, c := range []struct {
+		name string
+		a, b *warden.ClusterAdvertisement
+	}{
+		{"fewer nodes", capacityAd("b", 3), capacityAd("a", 5)},
+		{"known capacity", capacityAd("b", 5), unknown},
+		{"fewer cpus", &warden.ClusterAdvertisement{ClusterId: "b", Capacity: &warden.ClusterAdvertisement_Capacity{MaxControllerNodes: 3, Cpus: 4}},
+			&warden.ClusterAdvertisement{ClusterId: "a", Capacity: &warden.ClusterAdvertisement_Capacity{MaxControllerNodes: 3, Cpus: 8}}},
+		{"less memory", &warden.ClusterAdvertisement{ClusterId: "b", Capacity: &warden.ClusterAdvertisement_Capacity{MaxControllerNodes: 3, MemoryMb: 4096}},
+			&warden.ClusterAdvertisement{ClusterId: "a", Capacity: &warden.ClusterAdvertisement_Capacity{MaxControllerNodes: 3, MemoryMb: 8192}}},
+		{"fewer features", capacityAd("b", 3), capacityAd("a", 3, "mininet")},
+		{"same size, lower id", capacityAd("a", 3), capacityAd("b", 3)},
+	} {
+		if !betterFit(c.a, c.b) {
+			t.Errorf("%s: expected %s to fit better than %s", c.name, c.a.ClusterId, c.b.ClusterId)
+		}
+		if betterFit(c.b, c.a) {
+			t.Errorf("%s: expected %s not to fit better than %s", c.name, c.b.ClusterId, c.a.ClusterId)
+		}
+	}
+}
+
+func TestAssignBestFit(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	for _, ad := range []*warden.ClusterAdvertisement{capacityAd("a", 5), capacityAd("b", 3), capacityAd("c", 3), capacityAd("d", 1)} {
+		s.clusters[keyFromCluster(&cluster{ad: ad})] = cluster{ad: ad}
+	}
+	// b and c are the smallest that hold 2 nodes, and b wins the tie
+	cl, ok := s.assignRequest(specRequest(2))
+	if !ok || cl.ad.ClusterId != "b" {
+		t.Fatalf("Expected cluster b to be assigned, got %v", cl)
+	}
+	req := specRequest(2)
+	req.RequestId = "ann"
+	if cl, ok = s.assignRequest(req); !ok || cl.ad.ClusterId != "c" {
+		t.Errorf("Expected cluster c to be assigned once b is reserved, got %v", cl)
+	}
+}
+
+func TestCheckSatisfiable(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	s.policy = &policy{MaxDuration: map[string]int32{"dummy": 120}}
+	ad := capacityAd("a", 3, "mininet")
+	ad.State = warden.ClusterAdvertisement_READY
+	s.clusters[keyFromCluster(&cluster{ad: ad})] = cluster{ad: ad}
+
+	long := specRequest(1)
+	long.Duration = 240
+	for _, c := range []struct {
+		name string
+		req  *warden.ClusterRequest
+		code codes.Code
+	}{
+		{"reserved cluster that fits", specRequest(3, "mininet"), codes.OK},
+		{"unknown type", &warden.ClusterRequest{RequestId: "tom", ClusterType: "ec2"}, codes.Unavailable},
+		{"too many nodes", specRequest(5), codes.FailedPrecondition},
+		{"missing feature", specRequest(1, "p4"), codes.FailedPrecondition},
+		{"too long", long, codes.InvalidArgument},
+	} {
+		if err := s.checkSatisfiable(c.req); grpc.Code(err) != c.code {
+			t.Errorf("%s: expected %v, got %v", c.name, c.code, err)
+		}
+	}
+
+	// requests for a restored cluster wait for its agent to tell what it can hold
+	s.restored[key{"b", "ec2"}] = &warden.ClusterAdvertisement{ClusterId: "b", ClusterType: "ec2"}
+	if err := s.checkSatisfiable(&warden.ClusterRequest{RequestId: "tom", ClusterType: "ec2"}); err != nil {
+		t.Errorf("Expected a request for a restored cluster to wait, got %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"google.golang.org/grpc/peer"
+	"net/http"
+	"sort"
+)
+
+// Agent and the clusters it hosts, as shown on the dashboard
+type agentView struct {
+	Name        string       `json:"name"`
+	ClusterType string       `json:"clusterType"`
+	Version     string       `json:"version,omitempty"`
+	Address     string       `json:"address,omitempty"`
+	Connected   int64        `json:"connectedTime"`
+	Clusters    []clusterRef `json:"clusters"`
+}
+
+type clusterRef struct {
+	ClusterId   string `json:"clusterId"`
+	ClusterType string `json:"clusterType"`
+}
+
+// GET /api/whoami: returns the user name of the client and whether they are an admin
+func (s *wardenServer) httpWhoami(w http.ResponseWriter, r *http.Request) {
+	id, err := s.identifyHTTP(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"user":     id.user,
+		"admin":    id.admin,
+		"userAuth": s.userAuth,
+	})
+}
+
+// GET /api/agents: lists the connected agents and the clusters each one hosts; agent addresses
+// are only shown to admins
+func (s *wardenServer) httpAgents(w http.ResponseWriter, r *http.Request) {
+	logClient(httpContext(r), "HTTP list agents from", nil)
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := s.identifyHTTP(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.lock.Lock()
+	views := make(map[*agentConn]*agentView, len(s.agents))
+	agents := make([]*agentView, 0, len(s.agents))
+	for _, a := range s.agents {
+		v := &agentView{
+			Name:        a.reg.Name,
+			ClusterType: a.reg.ClusterType,
+			Version:     a.reg.Version,
+			Connected:   a.connected.Unix(),
+			Clusters:    []clusterRef{},
+		}
+		if p, ok := peer.FromContext(a.Context()); ok && id.admin {
+			v.Address = p.Addr.String()
+		}
+		views[a] = v
+		agents = append(agents, v)
+	}
+	for k, cl := range s.clusters {
+		if v, ok := views[cl.agent]; ok {
+			v.Clusters = append(v.Clusters, clusterRef{k.cId, k.cType})
+		}
+	}
+	s.lock.Unlock()
+
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	for _, v := range agents {
+		sort.Slice(v.Clusters, func(i, j int) bool { return v.Clusters[i].ClusterId < v.Clusters[j].ClusterId })
+	}
+	writeJSON(w, agents)
+}
+
+// GET /dashboard: serves the web page showing the clusters, their reservations and agents
+func (s *wardenServer) httpDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	fmt.Fprint(w, dashboardPage)
+}
+
+// The dashboard is a single page that lists the clusters from /api/clusters and keeps them up to
+// date from /api/events; it is read with fetch rather than EventSource, so that the bearer token
+// can be sent along
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ONOS Warden</title>
+<style>
+body { font-family: sans-serif; margin: 1.5em; color: #222; }
+h1 { font-size: 1.4em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 10px; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f0f0f0; }
+td.nodes { font-family: monospace; font-size: 0.9em; white-space: pre; }
+.UNAVAILABLE { color: #999; }
+.AVAILABLE { color: #080; }
+.RESERVED { color: #b60; }
+.READY { color: #036; font-weight: bold; }
+.QUEUED { color: #609; }
+#status { float: right; font-size: 0.9em; color: #666; }
+#log { font-family: monospace; font-size: 0.85em; color: #555; max-height: 12em; overflow-y: auto; }
+button { margin-right: 4px; }
+</style>
+</head>
+<body>
+<div id="status">
+  <span id="user"></span>
+  <span id="auth">token <input id="token" type="password" size="20"> <button id="save">Sign in</button></span>
+  <span id="conn">connecting...</span>
+</div>
+<h1>ONOS Warden</h1>
+<table>
+  <thead><tr><th>Cluster</th><th>Type</th><th>State</th><th>Owner</th><th>Remaining</th><th>Nodes</th><th>Agent</th><th></th></tr></thead>
+  <tbody id="clusters"></tbody>
+</table>
+<h2>Activity</h2>
+<div id="log"></div>
+<script>
+"use strict";
+var STATES = ["UNAVAILABLE", "AVAILABLE", "RESERVED", "READY", "QUEUED"];
+var EVENT_WITHDRAWN = 1, EVENT_FAILED = 3, EVENT_PROGRESS = 4, REASON_AGENT_LOST = 1, REASON_REMOVED = 5;
+
+var clusters = {}, agents = {}, me = {user: "", admin: false};
+var agentsPending = false;
+
+function key(ad) { return ad.clusterId + "/" + ad.clusterType; }
+
+function headers() {
+  var h = {"Content-Type": "application/json"};
+  var token = localStorage.getItem("wardenToken");
+  if (token) { h["Authorization"] = "Bearer " + token; }
+  return h;
+}
+
+function api(path, body) {
+  var opts = {headers: headers(), credentials: "same-origin"};
+  if (body !== undefined) { opts.method = "POST"; opts.body = JSON.stringify(body); }
+  return fetch(path, opts).then(function(resp) {
+    return resp.json().then(function(v) {
+      if (!resp.ok) { throw new Error(v.message || resp.statusText); }
+      return v;
+    });
+  });
+}
+
+function log(msg) {
+  var div = document.createElement("div");
+  div.textContent = new Date().toLocaleTimeString() + "  " + msg;
+  var el = document.getElementById("log");
+  el.insertBefore(div, el.firstChild);
+}
+
+function remaining(ad) {
+  var info = ad.reservationInfo;
+  if (!info) { return ""; }
+  if (info.duration < 0) { return "indefinite"; }
+  var left = info.reservationStartTime + info.duration * 60 - Date.now() / 1000;
+  if (left <= 0) { return "expired"; }
+  var h = Math.floor(left / 3600), m = Math.floor(left % 3600 / 60);
+  return (h > 0 ? h + "h " : "") + m + "m";
+}
+
+function owner(ad) { return ad.reservationInfo ? ad.reservationInfo.userName : ""; }
+
+function cell(tr, text, cls) {
+  var td = document.createElement("td");
+  td.textContent = text;
+  if (cls) { td.className = cls; }
+  tr.appendChild(td);
+  return td;
+}
+
+function button(td, label, action) {
+  var b = document.createElement("button");
+  b.textContent = label;
+  b.onclick = action;
+  td.appendChild(b);
+}
+
+function render() {
+  var tbody = document.getElementById("clusters");
+  tbody.innerHTML = "";
+  Object.keys(clusters).sort().forEach(function(k) {
+    var ad = clusters[k], state = STATES[ad.state || 0];
+    var tr = document.createElement("tr");
+    cell(tr, ad.clusterId);
+    cell(tr, ad.clusterType);
+    cell(tr, state + (ad.queuePosition ? " #" + ad.queuePosition : ""), state);
+    cell(tr, owner(ad));
+    var cost = ad.reservationInfo && ad.reservationInfo.estimatedCost;
+    cell(tr, remaining(ad) + (cost ? " ($" + cost.toFixed(2) + " so far)" : ""));
+    var nodes = (ad.nodes || []).map(function(n) { return n.id + ": " + n.ip; });
+    if (ad.headNodeIP) { nodes.unshift("head: " + ad.headNodeIP); }
+    cell(tr, nodes.join("\n"), "nodes");
+    cell(tr, agents[k] || "");
+    var actions = cell(tr, "");
+    var mine = owner(ad) !== "" && (me.admin || owner(ad) === me.user);
+    if (mine && (state === "RESERVED" || state === "READY")) {
+      button(actions, "Extend", function() { extend(ad); });
+      button(actions, "Return", function() { giveBack(ad); });
+    }
+    tbody.appendChild(tr);
+  });
+}
+
+function request(type, ad, duration) {
+  var req = {requestId: ad.requestId, clusterId: ad.clusterId, clusterType: ad.clusterType};
+  if (duration !== undefined) { req.duration = duration; }
+  return api("/api/requests/" + type, req).then(function() {
+    log(type + " of " + ad.clusterId + " done");
+  }, function(err) {
+    log(type + " of " + ad.clusterId + " failed: " + err.message);
+  });
+}
+
+function extend(ad) {
+  var minutes = prompt("Extend the reservation of " + ad.clusterId + " to this many minutes from now:", "60");
+  if (minutes === null) { return; }
+  var duration = parseInt(minutes, 10);
+  if (isNaN(duration)) { log("invalid duration: " + minutes); return; }
+  request("extend", ad, duration);
+}
+
+function giveBack(ad) {
+  if (confirm("Return " + ad.clusterId + "?")) { request("return", ad); }
+}
+
+function loadAgents() {
+  if (agentsPending) { return; }
+  agentsPending = true;
+  api("/api/agents").then(function(list) {
+    agents = {};
+    list.forEach(function(a) {
+      a.clusters.forEach(function(c) { agents[c.clusterId + "/" + c.clusterType] = a.name; });
+    });
+    agentsPending = false;
+    render();
+  }, function(err) {
+    agentsPending = false;
+    log("failed to list agents: " + err.message);
+  });
+}
+
+function update(ad) {
+  var k = key(ad), ev = ad.event;
+  if (ev && ev.type === EVENT_FAILED) {
+    log("request " + ad.requestId + " on " + ad.clusterId + " failed: " + ev.message);
+    return;
+  }
+  if (ev && ev.type === EVENT_PROGRESS) {
+    log(ad.clusterId + ": " + ev.message + (ev.steps ? " (" + ev.step + "/" + ev.steps + ")" : ""));
+    return;
+  }
+  if (ev && ev.message) { log(ad.clusterId + ": " + ev.message); }
+  if (ev && ev.type === EVENT_WITHDRAWN && (ev.reason === REASON_AGENT_LOST || ev.reason === REASON_REMOVED)) {
+    delete clusters[k];
+    delete agents[k];
+  } else {
+    if (!(k in agents)) { loadAgents(); }
+    clusters[k] = ad;
+  }
+  render();
+}
+
+function connect() {
+  var conn = document.getElementById("conn");
+  fetch("/api/events", {headers: headers(), credentials: "same-origin"}).then(function(resp) {
+    if (!resp.ok) { throw new Error(resp.status + " " + resp.statusText); }
+    conn.textContent = "live";
+    clusters = {};
+    var reader = resp.body.getReader(), decoder = new TextDecoder(), buf = "";
+    function read() {
+      return reader.read().then(function(r) {
+        if (r.done) { throw new Error("stream closed"); }
+        buf += decoder.decode(r.value, {stream: true});
+        var events = buf.split("\n\n");
+        buf = events.pop();
+        events.forEach(function(e) {
+          e.split("\n").forEach(function(line) {
+            if (line.indexOf("data: ") === 0) { update(JSON.parse(line.substring(6))); }
+          });
+        });
+        return read();
+      });
+    }
+    return read();
+  }).catch(function(err) {
+    conn.textContent = "disconnected (" + err.message + "); retrying...";
+    setTimeout(connect, 5000);
+  });
+}
+
+function whoami() {
+  return api("/api/whoami").then(function(v) {
+    me = v;
+    document.getElementById("user").textContent = v.userAuth ? "signed in as " + v.user + (v.admin ? " (admin)" : "") : "";
+    document.getElementById("auth").style.display = "none";
+    render();
+  }, function(err) {
+    document.getElementById("user").textContent = err.message;
+  });
+}
+
+document.getElementById("save").onclick = function() {
+  localStorage.setItem("wardenToken", document.getElementById("token").value);
+  location.reload();
+};
+
+whoami();
+loadAgents();
+connect();
+setInterval(render, 30000);
+</script>
+</body>
+</html>
+`
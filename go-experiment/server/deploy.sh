@@ -9,7 +9,7 @@ SSH_USER=${SSH_USER:-${2:-$USER}}
 cd $(dirname "$0")
 
 # Build warden server for Linux
-GOOS=linux go build -o warden-server server.go
+GOOS=linux go build -o warden-server .
 echo "Built server..."
 ls -lh warden-server
 
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"time"
+)
+
+// A point in time at which a reservation expires, or at which its holder is warned about it
+type deadline struct {
+	k     key
+	rId   string
+	at    time.Time
+	end   time.Time
+	warn  bool
+	index int
+}
+
+// Min-heap of deadlines, earliest first
+type deadlineHeap []*deadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	d := x.(*deadline)
+	d.index = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	d := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	d.index = -1
+	return d
+}
+
+// Tracks the deadlines of every reservation; at most one reservation is scheduled per cluster
+type expiryScheduler struct {
+	entries deadlineHeap
+	byKey   map[key][]*deadline
+
+	// how long before the end of a reservation its holder is warned
+	warnings []time.Duration
+}
+
+func newExpiryScheduler(warnings []time.Duration) *expiryScheduler {
+	return &expiryScheduler{
+		byKey:    make(map[key][]*deadline),
+		warnings: warnings,
+	}
+}
+
+// Schedules the reservation of the cluster to end at the given time, replacing any previous
+// deadlines of the cluster; returns false if the reservation was already scheduled that way
+func (e *expiryScheduler) schedule(k key, rId string, end time.Time, now time.Time) bool {
+	if l, ok := e.byKey[k]; ok && len(l) > 0 && l[0].rId == rId && l[0].end.Equal(end) {
+		return false
+	}
+	e.cancel(k)
+	l := []*deadline{{k: k, rId: rId, at: end, end: end}}
+	for _, w := range e.warnings {
+		if at := end.Add(-w); at.After(now) {
+			l = append(l, &deadline{k: k, rId: rId, at: at, end: end, warn: true})
+		}
+	}
+	for _, d := range l {
+		heap.Push(&e.entries, d)
+	}
+	e.byKey[k] = l
+	return true
+}
+
+// Removes all deadlines of the cluster
+func (e *expiryScheduler) cancel(k key) {
+	for _, d := range e.byKey[k] {
+		if d.index >= 0 {
+			heap.Remove(&e.entries, d.index)
+		}
+	}
+	delete(e.byKey, k)
+}
+
+// Returns the earliest pending deadline
+func (e *expiryScheduler) next() (time.Time, bool) {
+	if len(e.entries) == 0 {
+		return time.Time{}, false
+	}
+	return e.entries[0].at, true
+}
+
+// Removes and returns the deadlines that are due at the given time, earliest first
+func (e *expiryScheduler) due(now time.Time) []*deadline {
+	var l []*deadline
+	for len(e.entries) > 0 && !e.entries[0].at.After(now) {
+		d := heap.Pop(&e.entries).(*deadline)
+		if !d.warn {
+			// the reservation is over, so none of its deadlines are needed anymore
+			e.cancel(d.k)
+		}
+		l = append(l, d)
+	}
+	return l
+}
+
+// Returns the time at which the reservation of the cluster ends, if it expires at all
+func reservationEnd(ad *warden.ClusterAdvertisement) (time.Time, bool) {
+	switch ad.State {
+	case warden.ClusterAdvertisement_RESERVED, warden.ClusterAdvertisement_READY:
+	default:
+		return time.Time{}, false
+	}
+	info := ad.ReservationInfo
+	if info == nil || info.Duration < 0 {
+		// Reservation does not expire
+		return time.Time{}, false
+	}
+	end := time.Unix(info.ReservationStartTime, 0)
+	return end.Add(time.Duration(info.Duration) * time.Minute), true
+}
+
+func (s *wardenServer) scheduleExpiry(cl *cluster) {
+	// Note: callers must hold s.lock
+	k := keyFromCluster(cl)
+	end, ok := reservationEnd(cl.ad)
+	if !ok {
+		s.cancelExpiry(k)
+		return
+	}
+	if s.expiry.schedule(k, cl.ad.RequestId, end, time.Now()) {
+		fmt.Printf("Reservation %s of cluster %s (%s) expires at %v\n",
+			cl.ad.RequestId, k.cId, k.cType, end.Format(time.RFC3339))
+		s.armExpiryTimer()
+	}
+}
+
+func (s *wardenServer) cancelExpiry(k key) {
+	// Note: callers must hold s.lock
+	if _, ok := s.expiry.byKey[k]; ok {
+		s.expiry.cancel(k)
+		s.armExpiryTimer()
+	}
+}
+
+// Sets the timer to fire at the earliest pending deadline
+func (s *wardenServer) armExpiryTimer() {
+	// Note: callers must hold s.lock
+	at, ok := s.expiry.next()
+	if !ok {
+		if s.expiryTimer != nil {
+			s.expiryTimer.Stop()
+		}
+		return
+	}
+	wait := at.Sub(time.Now())
+	if s.expiryTimer == nil {
+		s.expiryTimer = time.AfterFunc(wait, s.expireReservations)
+	} else {
+		s.expiryTimer.Reset(wait)
+	}
+}
+
+// Warns the holders of reservations that are about to end, and returns the reservations that have ended
+func (s *wardenServer) expireReservations() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, d := range s.expiry.due(time.Now()) {
+		cl, ok := s.clusters[d.k]
+		if !ok || cl.ad.RequestId != d.rId {
+			// reservation has already gone away
+			continue
+		}
+		if d.warn {
+			if s.expiryWarning != nil {
+				s.expiryWarning(&cl, d.end)
+			}
+			continue
+		}
+		fmt.Println("Reservation expired:", cl.ad)
+		s.returnCluster(&cl, warden.ClusterAdvertisement_Event_EXPIRED, "reservation expired")
+	}
+	s.armExpiryTimer()
+}
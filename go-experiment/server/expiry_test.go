@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"testing"
+	"time"
+)
+
+func TestExpiryScheduler(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	e := newExpiryScheduler([]time.Duration{10 * time.Minute, time.Minute})
+	a := key{"a", "dummy"}
+	b := key{"b", "dummy"}
+
+	e.schedule(a, "tom", now.Add(30*time.Minute), now)
+	// the 10 minute warning has already passed for b
+	e.schedule(b, "bob", now.Add(5*time.Minute), now)
+	if at, _ := e.next(); !at.Equal(now.Add(4 * time.Minute)) {
+		t.Errorf("Expected b's warning first, got %v", at)
+	}
+	if e.schedule(b, "bob", now.Add(5*time.Minute), now) {
+		t.Error("Rescheduling the same deadline should not change anything")
+	}
+
+	// extending b re-arms its deadlines
+	e.schedule(b, "bob", now.Add(60*time.Minute), now)
+	if at, _ := e.next(); !at.Equal(now.Add(20 * time.Minute)) {
+		t.Errorf("Expected a's warning first, got %v", at)
+	}
+
+	due := e.due(now.Add(30 * time.Minute))
+	if len(due) != 3 {
+		t.Fatalf("Expected 3 deadlines due, got %d", len(due))
+	}
+	if !due[0].warn || !due[1].warn || due[2].warn || due[2].k != a {
+		t.Errorf("Expected a's warnings before its expiry, got %+v %+v %+v", due[0], due[1], due[2])
+	}
+	if _, ok := e.byKey[a]; ok {
+		t.Error("Expected a's deadlines to be dropped after it expired")
+	}
+
+	e.cancel(b)
+	if _, ok := e.next(); ok {
+		t.Error("Expected no deadlines after cancelling b")
+	}
+}
+
+func TestExpiryWarning(t *testing.T) {
+	s := newServer(nopStore{}, []time.Duration{10 * time.Minute})
+	k := key{"a", "dummy"}
+	end := time.Now().Add(10 * time.Minute)
+	s.clusters[k] = cluster{ad: &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy",
+		State: warden.ClusterAdvertisement_READY, RequestId: "tom"}}
+	var warned []string
+	s.expiryWarning = func(cl *cluster, at time.Time) {
+		warned = append(warned, cl.ad.RequestId)
+		if !at.Equal(end) {
+			t.Errorf("Expected the warning to carry the end of the reservation, got %v", at)
+		}
+	}
+
+	// the warning is due now, but the reservation has 10 minutes left
+	s.expiry.schedule(k, "tom", end, time.Now().Add(-time.Minute))
+	s.expireReservations()
+	s.expiryTimer.Stop()
+	if len(warned) != 1 || warned[0] != "tom" {
+		t.Errorf("Expected tom to be warned once, got %v", warned)
+	}
+	if s.clusters[k].ad.State != warden.ClusterAdvertisement_READY {
+		t.Errorf("Expected the reservation to be kept until its end, got %v", s.clusters[k].ad)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Builds the advertisement telling clients that a request could not be carried out; the cluster's
+// current advertisement, if any, is copied so that its state is left as is
+func failureAd(cl *cluster, k key, rId string, code codes.Code, msg string) *warden.ClusterAdvertisement {
+	var ad warden.ClusterAdvertisement
+	if cl != nil {
+		ad = *cl.ad
+	} else {
+		ad = warden.ClusterAdvertisement{
+			ClusterId:   k.cId,
+			ClusterType: k.cType,
+			State:       warden.ClusterAdvertisement_UNAVAILABLE,
+		}
+	}
+	ad.RequestId = rId
+	ad.Event = &warden.ClusterAdvertisement_Event{
+		Type:    warden.ClusterAdvertisement_Event_FAILED,
+		Code:    uint32(code),
+		Message: msg,
+	}
+	return &ad
+}
+
+// Same as failureAd, taking the code and message from a gRPC error
+func errorAd(cl *cluster, k key, rId string, err error) *warden.ClusterAdvertisement {
+	return failureAd(cl, k, rId, grpc.Code(err), grpc.ErrorDesc(err))
+}
+
+// Returns the error for a client that was waiting on the request and got the given reply
+func replyError(rId string, ad *warden.ClusterAdvertisement) error {
+	if ad == nil {
+		return grpc.Errorf(codes.Aborted, "Request %s was abandoned", rId)
+	}
+	if ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_FAILED {
+		return grpc.Errorf(codes.Code(ad.Event.Code), "%s", ad.Event.Message)
+	}
+	return nil
+}
+
+// Delivers the failure to each waiter; waiters are buffered and receive at most one reply
+func failWaiters(waiters []chan *warden.ClusterAdvertisement, ad *warden.ClusterAdvertisement) {
+	for _, ch := range waiters {
+		ch <- ad
+	}
+}
+
+func (s *wardenServer) requestFailed(agent *agentConn, f *warden.RequestAck) {
+	// Note: callers must hold s.lock
+	k := key{f.ClusterId, f.ClusterType}
+	if rk, ok := s.requests[f.RequestId]; ok && f.ClusterId == "" {
+		k = rk
+	}
+	var cl *cluster
+	if c, ok := s.clusters[k]; ok {
+		if c.agent != agent {
+			fmt.Printf("Ignoring failure of request %s from %s; cluster %s belongs to %s\n",
+				f.RequestId, agent, k.cId, c.agent)
+			return
+		}
+		cl = &c
+	}
+	ad := failureAd(cl, k, f.RequestId, codes.Code(f.Code), f.Message)
+	s.metrics.requestRejected(f.Type, codes.Code(f.Code))
+	user, _ := s.requestOwner(f.RequestId)
+	s.auditFailure(f, user)
+
+	// Release a reservation that the agent could not make, so that the cluster can be assigned again
+	released := false
+	if cl != nil && f.Type == warden.ClusterRequest_RESERVE &&
+		cl.ad.RequestId == f.RequestId && cl.ad.State == warden.ClusterAdvertisement_RESERVED {
+		rel := *cl.ad
+		rel.State = warden.ClusterAdvertisement_AVAILABLE
+		rel.RequestId = ""
+		s.metrics.clusterUpdated(k, cl.ad, &rel)
+		s.auditTransition(k, cl.ad, &rel, f.Message)
+		cl.ad = &rel
+		s.clusters[k] = *cl
+		delete(s.requests, f.RequestId)
+		delete(s.owners, f.RequestId)
+		delete(s.sessions, f.RequestId)
+		s.journal(opUpdate, cl.ad)
+		// the user has no cell to show for the hours charged when the request was assigned
+		s.refundRequest(f.RequestId)
+		released = true
+	}
+	switch f.Type {
+	case warden.ClusterRequest_EXTEND:
+		// the reservation keeps its old end, so undo the charge of the extension
+		s.refundRequest(f.RequestId)
+	case warden.ClusterRequest_RETURN:
+		// the holder keeps the reservation, so take back what the return gave back
+		delete(s.returns, f.RequestId)
+		s.refundRequest(f.RequestId)
+	}
+
+	// Fail only the waiters of the failed request; others may still be served by the cluster
+	var rest []waiter
+	for _, wt := range s.waiters[k] {
+		if wt.rId == f.RequestId {
+			wt.ch <- ad
+		} else {
+			rest = append(rest, wt)
+		}
+	}
+	if len(rest) > 0 {
+		s.waiters[k] = rest
+	} else {
+		delete(s.waiters, k)
+	}
+	s.sendUpdate(ad)
+	if released {
+		s.drainQueue()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"testing"
+	"time"
+)
+
+func TestReplyError(t *testing.T) {
+	if err := replyError("tom", nil); grpc.Code(err) != codes.Aborted {
+		t.Errorf("Expected Aborted for an abandoned request, got %v", err)
+	}
+	ready := &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_READY}
+	if err := replyError("tom", ready); err != nil {
+		t.Errorf("Expected no error for a ready cluster, got %v", err)
+	}
+
+	cl := &cluster{ad: ready}
+	err := grpc.Errorf(codes.ResourceExhausted, "out of instances")
+	ad := errorAd(cl, keyFromCluster(cl), "tom", err)
+	if ad.State != warden.ClusterAdvertisement_READY || ad.RequestId != "tom" || ready.Event != nil {
+		t.Errorf("Expected a copy of the cluster's advertisement, got %v", ad)
+	}
+	err = replyError("tom", ad)
+	if grpc.Code(err) != codes.ResourceExhausted || grpc.ErrorDesc(err) != "out of instances" {
+		t.Errorf("Expected the agent's failure, got %v", err)
+	}
+}
+
+func TestRequestFailed(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	agent := &agentConn{reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	cl := &cluster{agent: agent, ad: &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy",
+		State: warden.ClusterAdvertisement_RESERVED, RequestId: "tom"}}
+	k := keyFromCluster(cl)
+	s.clusters[k] = *cl
+	s.requests["tom"] = k
+	tom := s.waitForReady(cl, "tom")
+	ann := s.waitForReady(cl, "ann")
+
+	s.requestFailed(agent, &warden.RequestAck{RequestId: "ann", ClusterId: "a", ClusterType: "dummy",
+		Type: warden.ClusterRequest_EXTEND, Phase: warden.RequestAck_REJECTED, Code: uint32(codes.FailedPrecondition)})
+	select {
+	case ad := <-ann:
+		if err := replyError("ann", ad); grpc.Code(err) != codes.FailedPrecondition {
+			t.Errorf("Expected ann's request to fail, got %v", err)
+		}
+	default:
+		t.Error("Expected ann's waiter to be failed")
+	}
+	select {
+	case ad := <-tom:
+		t.Errorf("Expected tom to keep waiting for the cluster, got %v", ad)
+	default:
+	}
+	if w := s.waiters[k]; len(w) != 1 || w[0].rId != "tom" {
+		t.Errorf("Expected only tom to be waiting, got %v", w)
+	}
+}
+
+func TestRequestFailedRefunds(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	agent := &agentConn{stream: &sendingAgentStream{}, reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	k := key{"a", "dummy"}
+	s.clusters[k] = cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}}
+
+	// the agent rejects the reservation it was assigned
+	reserve := &warden.ClusterRequest{RequestId: "tom", Type: warden.ClusterRequest_RESERVE, Duration: 120}
+	if _, err := s.processRequest(identity{user: "tom"}, reserve, nil); err != nil {
+		t.Fatal(err)
+	}
+	if used := s.cellHours("tom"); used != 2 {
+		t.Errorf("Expected 2 cell-hours charged on assignment, got %v", used)
+	}
+	s.requestFailed(agent, &warden.RequestAck{RequestId: "tom", ClusterId: "a", ClusterType: "dummy",
+		Type: warden.ClusterRequest_RESERVE, Phase: warden.RequestAck_REJECTED, Code: uint32(codes.ResourceExhausted)})
+	if used := s.cellHours("tom"); used != 0 {
+		t.Errorf("Expected the rejected reservation to be refunded, got %v", used)
+	}
+
+	// the agent then grants an hour, but rejects its extension to three
+	s.updateCluster(&cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_READY, RequestId: "tom",
+		ReservationInfo: &warden.ClusterAdvertisement_ReservationInfo{UserName: "tom", Duration: 60,
+			ReservationStartTime: time.Now().Unix()}}})
+	defer s.expiryTimer.Stop()
+	s.chargeCellHours("tom", 1)
+	extend := &warden.ClusterRequest{RequestId: "tom", Type: warden.ClusterRequest_EXTEND, Duration: 180}
+	if _, err := s.processRequest(identity{user: "tom"}, extend, nil); err != nil {
+		t.Fatal(err)
+	}
+	if used := s.cellHours("tom"); used < 2.9 {
+		t.Errorf("Expected the extension to be charged, got %v", used)
+	}
+	s.requestFailed(agent, &warden.RequestAck{RequestId: "tom", ClusterId: "a", ClusterType: "dummy",
+		Type: warden.ClusterRequest_EXTEND, Phase: warden.RequestAck_REJECTED, Code: uint32(codes.ResourceExhausted)})
+	if used := s.cellHours("tom"); used < 0.99 || used > 1.01 {
+		t.Errorf("Expected only the hour granted to be charged, got %v", used)
+	}
+}
+
+func TestReturnFailed(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	agent := &agentConn{stream: &sendingAgentStream{}, reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	s.updateCluster(&cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_READY, RequestId: "tom",
+		ReservationInfo: &warden.ClusterAdvertisement_ReservationInfo{UserName: "tom", Duration: 120,
+			ReservationStartTime: time.Now().Unix()}}})
+	defer s.expiryTimer.Stop()
+	s.chargeCellHours("tom", 2)
+	events := newSSEClient(context.Background())
+	s.clients[events] = true
+	withdrawn := func() bool {
+		for len(events.ads) > 0 {
+			if ad := <-events.ads; ad.Event != nil && ad.Event.Type == warden.ClusterAdvertisement_Event_WITHDRAWN {
+				return true
+			}
+		}
+		return false
+	}
+	ret := &warden.ClusterRequest{RequestId: "tom", Type: warden.ClusterRequest_RETURN}
+
+	// the return is refunded right away, but only announced once the agent takes it on
+	if _, err := s.processRequest(identity{user: "tom"}, ret, nil); err != nil {
+		t.Fatal(err)
+	}
+	if used := s.cellHours("tom"); used > 0.01 {
+		t.Errorf("Expected the unused hours to be refunded, got %v", used)
+	}
+	if withdrawn() {
+		t.Error("Expected no withdrawal before the agent acknowledges the return")
+	}
+
+	// the agent rejects the return, so tom keeps the reservation and what it cost
+	s.requestFailed(agent, &warden.RequestAck{RequestId: "tom", ClusterId: "a", ClusterType: "dummy",
+		Type: warden.ClusterRequest_RETURN, Phase: warden.RequestAck_REJECTED, Code: uint32(codes.FailedPrecondition)})
+	if used := s.cellHours("tom"); used < 1.99 || used > 2.01 {
+		t.Errorf("Expected the refund to be taken back, got %v", used)
+	}
+	if withdrawn() {
+		t.Error("Expected no withdrawal of a rejected return")
+	}
+
+	// returned again, and accepted this time
+	if _, err := s.processRequest(identity{user: "tom"}, ret, nil); err != nil {
+		t.Fatal(err)
+	}
+	s.handleAck(agent, &warden.RequestAck{RequestId: "tom", ClusterId: "a", ClusterType: "dummy",
+		Type: warden.ClusterRequest_RETURN, Phase: warden.RequestAck_ACCEPTED})
+	if !withdrawn() {
+		t.Error("Expected the reservation to be withdrawn once the agent accepts the return")
+	}
+	if used := s.cellHours("tom"); used > 0.01 {
+		t.Errorf("Expected the unused hours to be refunded, got %v", used)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/util"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/peer"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of advertisements buffered for each event stream before updates are dropped
+const eventBuffer = 256
+
+// Minutes reserved by legacy requests without a duration, as with the DEFAULT_MINUTES of the servlet
+const legacyDefaultMinutes = 120
+
+// Serves the ClusterClientService as HTTP/JSON under /api/, the dashboard at /dashboard, metrics
+// at /metrics and the plain text interface of the legacy warden servlet at /
+func (s *wardenServer) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/clusters", s.httpClusters)
+	mux.HandleFunc("/api/requests/", s.httpRequest)
+	mux.HandleFunc("/api/events", s.httpEvents)
+	mux.HandleFunc("/api/agents", s.httpAgents)
+	mux.HandleFunc("/api/whoami", s.httpWhoami)
+	mux.HandleFunc("/dashboard", s.httpDashboard)
+	mux.HandleFunc("/metrics", s.httpMetrics)
+	mux.HandleFunc("/", s.httpLegacy)
+	return mux
+}
+
+// Serves the gateway on the given address, over TLS if it is enabled
+func (s *wardenServer) serveHTTP(addr string, tlsFlags *util.TLSFlags) {
+	srv := &http.Server{Addr: addr, Handler: s.httpHandler()}
+	var err error
+	if tlsFlags.Enabled() {
+		srv.TLSConfig, err = tlsFlags.ServerConfig()
+		if err != nil {
+			grpclog.Fatalf("failed to load TLS credentials: %v", err)
+		}
+		fmt.Println("serving HTTPS gateway on", addr)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		fmt.Println("serving HTTP gateway on", addr)
+		err = srv.ListenAndServe()
+	}
+	grpclog.Fatalf("failed to serve HTTP gateway: %v", err)
+}
+
+// Returns the request's context, carrying the client's address for logging
+func httpContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		ctx = peer.NewContext(ctx, &peer.Peer{Addr: addr})
+	}
+	return ctx
+}
+
+// Returns the identity of the HTTP client, taken from its verified certificate or its bearer token
+func (s *wardenServer) identifyHTTP(r *http.Request) (identity, error) {
+	if !s.userAuth {
+		return identity{admin: true}, nil
+	}
+	var user string
+	if r.TLS != nil {
+		user = s.certUser(*r.TLS)
+	}
+	if user == "" {
+		user = s.tokenUser(r.Header.Get("Authorization"))
+	}
+	return s.identityOf(user)
+}
+
+// Maps gRPC status codes onto HTTP status codes
+func httpStatus(err error) int {
+	switch grpc.Code(err) {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Canceled:
+		// nginx's "client closed request"
+		return 499
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println("Failed to write JSON response:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(err))
+	json.NewEncoder(w).Encode(map[string]string{
+		"code":    grpc.Code(err).String(),
+		"message": grpc.ErrorDesc(err),
+	})
+}
+
+// Returns a copy of the advertisement of every cluster, ordered by cluster id
+func (s *wardenServer) snapshot() []*warden.ClusterAdvertisement {
+	// Note: callers must hold s.lock
+	ads := make([]*warden.ClusterAdvertisement, 0, len(s.clusters))
+	for _, cl := range s.clusters {
+		ad := *cl.ad
+		ads = append(ads, &ad)
+	}
+	sort.Slice(ads, func(i, j int) bool {
+		if ads[i].ClusterId != ads[j].ClusterId {
+			return ads[i].ClusterId < ads[j].ClusterId
+		}
+		return ads[i].ClusterType < ads[j].ClusterType
+	})
+	return ads
+}
+
+// GET /api/clusters: lists the advertisements of all clusters
+func (s *wardenServer) httpClusters(w http.ResponseWriter, r *http.Request) {
+	logClient(httpContext(r), "HTTP list from", nil)
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	s.lock.Lock()
+	ads := s.snapshot()
+	s.lock.Unlock()
+	writeJSON(w, ads)
+}
+
+var requestTypes = map[string]warden.ClusterRequest_RequestType{
+	"reserve": warden.ClusterRequest_RESERVE,
+	"extend":  warden.ClusterRequest_EXTEND,
+	"return":  warden.ClusterRequest_RETURN,
+	"status":  warden.ClusterRequest_STATUS,
+}
+
+// POST /api/requests/{reserve,extend,return,status}: makes the request given as a JSON
+// ClusterRequest and replies with the cluster's advertisement once the request is done
+func (s *wardenServer) httpRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := httpContext(r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	t, ok := requestTypes[strings.TrimPrefix(r.URL.Path, "/api/requests/")]
+	if !ok {
+		http.Error(w, "request type must be one of reserve, extend, return or status", http.StatusNotFound)
+		return
+	}
+	req := new(warden.ClusterRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, grpc.Errorf(codes.InvalidArgument, "invalid request: %v", err))
+		return
+	}
+	req.Type = t
+	logClient(ctx, "New HTTP request from", req)
+
+	id, err := s.identifyHTTP(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ad, err := s.handleRequest(ctx, id, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, ad)
+}
+
+// Client of the event stream; advertisements are buffered so that updates never block the server
+type sseClient struct {
+	ctx context.Context
+	ads chan *warden.ClusterAdvertisement
+	// closed once an update has been dropped, after which the stream is ended so that the client
+	// reconnects and starts over from a fresh snapshot
+	lost chan struct{}
+}
+
+func newSSEClient(ctx context.Context) *sseClient {
+	return &sseClient{
+		ctx:  ctx,
+		ads:  make(chan *warden.ClusterAdvertisement, eventBuffer),
+		lost: make(chan struct{}),
+	}
+}
+
+func (c *sseClient) Send(ad *warden.ClusterAdvertisement) error {
+	// Note: callers must hold s.lock, which keeps lost from being closed twice
+	select {
+	case c.ads <- ad:
+		return nil
+	default:
+	}
+	select {
+	case <-c.lost:
+	default:
+		close(c.lost)
+	}
+	return errors.New("event stream is falling behind; closing it")
+}
+
+func (c *sseClient) Context() context.Context {
+	return c.ctx
+}
+
+// GET /api/events: streams the advertisements of all clusters, followed by every update, as
+// server-sent events
+func (s *wardenServer) httpEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := httpContext(r)
+	logClient(ctx, "New HTTP event stream from", nil)
+	if _, err := s.identifyHTTP(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c := newSSEClient(ctx)
+	s.lock.Lock()
+	snapshot := s.snapshot()
+	s.clients[c] = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		delete(s.clients, c)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, ad := range snapshot {
+		if err := writeEvent(w, ad); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-ctx.Done():
+			logClient(ctx, "HTTP event stream closed from", nil)
+			return
+		case <-c.lost:
+			logClient(ctx, "Closing HTTP event stream that fell behind from", nil)
+			return
+		case ad := <-c.ads:
+			if err := writeEvent(w, ad); err != nil {
+				logClient(ctx, "Error writing event to", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ad *warden.ClusterAdvertisement) error {
+	b, err := json.Marshal(ad)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: advertisement\ndata: %s\n\n", b)
+	return err
+}
+
+// Serves the plain text interface of the legacy warden servlet, so that curl-based scripts keep
+// working; reservations are made with the user name as their request id:
+//
+//	GET /             table of cells and their reservations
+//	GET /data         "cell,spec,user,minutes remaining" per reserved cell, or just "cell"
+//	GET /data?user=u  the line for u's reservation
+//	POST /?user=u&duration=m&spec=3+1   reserves a cell for the SSH key in the body and
+//	                  replies with its cell definition
+//	DELETE /?user=u   returns u's cell
+func (s *wardenServer) httpLegacy(w http.ResponseWriter, r *http.Request) {
+	ctx := httpContext(r)
+	logClient(ctx, "Legacy HTTP "+r.Method+" "+r.URL.String()+" from", nil)
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	switch r.Method {
+	case http.MethodGet:
+		s.lock.Lock()
+		ads := s.snapshot()
+		s.lock.Unlock()
+		if strings.HasSuffix(r.URL.Path, "data") {
+			if user := r.URL.Query().Get("user"); user != "" {
+				for _, ad := range ads {
+					if ad.ReservationInfo != nil && ad.ReservationInfo.UserName == user {
+						fmt.Fprintln(w, cellStatus(ad))
+					}
+				}
+				return
+			}
+			for _, ad := range ads {
+				fmt.Fprintln(w, cellStatus(ad))
+			}
+			return
+		}
+		for _, ad := range ads {
+			fmt.Fprintln(w, cellAvailability(ad))
+		}
+
+	case http.MethodPost, http.MethodDelete:
+		q := r.URL.Query()
+		user := q.Get("user")
+		if user == "" {
+			http.Error(w, "user is required", http.StatusBadRequest)
+			return
+		}
+		req := &warden.ClusterRequest{
+			RequestId: user,
+			Type:      warden.ClusterRequest_RETURN,
+			Spec:      &warden.ClusterRequest_Spec{UserName: user},
+		}
+		if r.Method == http.MethodPost {
+			key, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			nodes, err := legacySpecNodes(q.Get("spec"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Type = warden.ClusterRequest_RESERVE
+			req.Spec.UserKey = string(key)
+			req.Spec.ControllerNodes = nodes
+			req.Duration = legacyDefaultMinutes
+			if d := q.Get("duration"); d != "" {
+				duration, err := strconv.Atoi(d)
+				if err != nil {
+					http.Error(w, "invalid duration: "+d, http.StatusBadRequest)
+					return
+				}
+				if duration != 0 {
+					req.Duration = int32(duration)
+				}
+			}
+			req.ClusterId = q.Get("cellNameHint")
+		}
+		id, err := s.identifyHTTP(r)
+		if err != nil {
+			http.Error(w, grpc.ErrorDesc(err), httpStatus(err))
+			return
+		}
+		ad, err := s.handleRequest(ctx, id, req)
+		if err != nil {
+			http.Error(w, grpc.ErrorDesc(err), httpStatus(err))
+			return
+		}
+		if req.Type == warden.ClusterRequest_RESERVE {
+			fmt.Fprint(w, cellDefinition(ad))
+		}
+
+	default:
+		http.Error(w, "unsupported method "+r.Method, http.StatusMethodNotAllowed)
+	}
+}
+
+var legacySpec = regexp.MustCompile(`^(\d{1,2})\+\d{1,2}(\+[0-1])?$`)
+
+// Returns the number of controller nodes of a legacy cell spec, e.g. "3+1"; defaults to 3
+func legacySpecNodes(spec string) (uint32, error) {
+	if spec == "" {
+		return 3, nil
+	}
+	m := legacySpec.FindStringSubmatch(spec)
+	if m == nil {
+		return 0, fmt.Errorf("invalid cell spec string %s", spec)
+	}
+	n, _ := strconv.Atoi(m[1])
+	return uint32(n), nil
+}
+
+// Returns the minutes left of the reservation, and when it ends
+func minutesRemaining(ad *warden.ClusterAdvertisement) (int64, time.Time) {
+	end, ok := reservationEnd(ad)
+	if !ok {
+		return -1, time.Time{}
+	}
+	return int64(end.Sub(time.Now()) / time.Minute), end
+}
+
+func cellStatus(ad *warden.ClusterAdvertisement) string {
+	info := ad.ReservationInfo
+	if info == nil {
+		return ad.ClusterId
+	}
+	remaining, _ := minutesRemaining(ad)
+	return fmt.Sprintf("%s,%d,%s,%d", ad.ClusterId, len(ad.Nodes), info.UserName, remaining)
+}
+
+func cellAvailability(ad *warden.ClusterAdvertisement) string {
+	info := ad.ReservationInfo
+	if info == nil {
+		state := "available"
+		if ad.State != warden.ClusterAdvertisement_AVAILABLE {
+			state = strings.ToLower(ad.State.String())
+		}
+		return fmt.Sprintf("%-10s\t%-10s", ad.ClusterId, state)
+	}
+	const layout = "2006-01-02 15:04:05"
+	start := time.Unix(info.ReservationStartTime, 0)
+	remaining, end := minutesRemaining(ad)
+	ends := "never"
+	if !end.IsZero() {
+		ends = end.Format(layout)
+	}
+	return fmt.Sprintf("%-14s\t%-25s\t%s\t%s\t%d mins (%d remaining)",
+		fmt.Sprintf("%s-%d", ad.ClusterId, len(ad.Nodes)), info.UserName,
+		start.Format(layout), ends, info.Duration, remaining)
+}
+
+// Returns the cell definition of a reserved cluster, as the legacy warden did
+func cellDefinition(ad *warden.ClusterAdvertisement) string {
+	var b bytes.Buffer
+	b.WriteString("export ONOS_CELL=borrow\n")
+	fmt.Fprintf(&b, "export OCT=%s\n", ad.HeadNodeIP)
+	for _, n := range ad.Nodes {
+		if n.Id == 0 {
+			fmt.Fprintf(&b, "export OCN=%s\n", n.Ip)
+			continue
+		}
+		if n.Id == 1 {
+			nic := regexp.MustCompile(".[0-9]+$").ReplaceAllString(n.Ip, ".*")
+			fmt.Fprintf(&b, "export ONOS_NIC=\"%s\"\n", nic)
+		}
+		fmt.Fprintf(&b, "export OC%d=%s\n", n.Id, n.Ip)
+	}
+	b.WriteString("export ONOS_USER=sdn\n")
+	b.WriteString("export ONOS_USE_SSH=true\n")
+	b.WriteString("export ONOS_APPS=drivers,openflow,proxyarp,mobility,pathpainter\n")
+	b.WriteString("export ONOS_WEB_USER=onos\n")
+	b.WriteString("export ONOS_WEB_PASS=rocks\n")
+	return b.String()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	start := time.Now().Add(-10 * time.Minute).Unix()
+	s.clusters[key{"a", "dummy"}] = cluster{ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}}
+	s.clusters[key{"b", "dummy"}] = cluster{ad: &warden.ClusterAdvertisement{
+		ClusterId: "b", ClusterType: "dummy", State: warden.ClusterAdvertisement_READY, RequestId: "tom",
+		Nodes: []*warden.ClusterAdvertisement_ClusterNode{{Id: 1, Ip: "10.0.1.1"}},
+		ReservationInfo: &warden.ClusterAdvertisement_ReservationInfo{
+			UserName: "tom", Duration: 60, ReservationStartTime: start}}}
+	ts := httptest.NewServer(s.httpHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/clusters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ads []*warden.ClusterAdvertisement
+	if err := json.NewDecoder(resp.Body).Decode(&ads); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(ads) != 2 || ads[0].ClusterId != "a" || ads[1].RequestId != "tom" {
+		t.Errorf("Unexpected clusters %v", ads)
+	}
+
+	resp, err = http.Get(ts.URL + "/data?user=tom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if line := strings.TrimSpace(string(b)); line != "b,1,tom,49" && line != "b,1,tom,50" {
+		t.Errorf("Unexpected legacy status %q", line)
+	}
+
+	resp, err = http.Get(ts.URL + "/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("Unexpected dashboard response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	resp, err = http.Post(ts.URL+"/api/requests/bogus", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown request type, got %d", resp.StatusCode)
+	}
+}
+
+func TestLegacySpec(t *testing.T) {
+	for spec, nodes := range map[string]uint32{"": 3, "3+1": 3, "5+1+0": 5, "12+1": 12} {
+		if n, err := legacySpecNodes(spec); err != nil || n != nodes {
+			t.Errorf("Expected %d nodes for %q, got %d (%v)", nodes, spec, n, err)
+		}
+	}
+	if _, err := legacySpecNodes("three"); err == nil {
+		t.Error("Expected an invalid spec to be rejected")
+	}
+	if httpStatus(grpc.Errorf(codes.ResourceExhausted, "quota")) != http.StatusTooManyRequests {
+		t.Error("Expected ResourceExhausted to map to 429")
+	}
+}
+
+// Agent stream that records the requests sent to the agent
+type sendingAgentStream struct {
+	warden.ClusterAgentService_AgentClustersServer
+	sent []*warden.ClusterRequest
+	err  error
+}
+
+func (s *sendingAgentStream) Send(req *warden.ClusterRequest) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, req)
+	return nil
+}
+
+func (s *sendingAgentStream) Context() context.Context {
+	return context.Background()
+}
+
+func TestLegacyDefaultDuration(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	stream := &sendingAgentStream{}
+	agent := &agentConn{stream: stream, reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	s.clusters[key{"a", "dummy"}] = cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}}
+
+	// the agent never reports the cluster ready, so give up on the reply once it is forwarded
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodPost, "/?user=tom", strings.NewReader("ssh-rsa AAAA tom")).WithContext(ctx)
+	s.httpLegacy(httptest.NewRecorder(), r)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(stream.sent) != 1 || stream.sent[0].Duration != legacyDefaultMinutes {
+		t.Errorf("Expected a reservation for %d minutes, got %v", legacyDefaultMinutes, stream.sent)
+	}
+}
+
+func TestEventStreamOverflow(t *testing.T) {
+	c := newSSEClient(context.Background())
+	ad := &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy"}
+	for i := 0; i < eventBuffer; i++ {
+		if err := c.Send(ad); err != nil {
+			t.Fatalf("Expected update %d to be buffered, got %v", i, err)
+		}
+	}
+	select {
+	case <-c.lost:
+		t.Fatal("Expected the stream to be kept while updates fit in its buffer")
+	default:
+	}
+
+	// an update that does not fit ends the stream, however many more follow
+	for i := 0; i < 2; i++ {
+		if err := c.Send(ad); err == nil {
+			t.Error("Expected the update to be dropped")
+		}
+	}
+	select {
+	case <-c.lost:
+	default:
+		t.Error("Expected the stream to be closed after dropping an update")
+	}
+}
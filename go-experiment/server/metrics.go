@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc/codes"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bucket upper bounds, in seconds
+var (
+	provisioningBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800}
+	reservationBuckets  = []float64{900, 1800, 3600, 7200, 14400, 28800, 86400, 259200}
+)
+
+// Counters and histograms kept by the server, exposed in the Prometheus text format along with
+// gauges computed from the server's state when scraped; all metrics are guarded by s.lock
+type metrics struct {
+	rejected     *counterVec
+	sendErrors   *counterVec
+	provisioning *histogramVec
+	reservations *histogramVec
+	requested    *histogramVec
+
+	// time at which each cluster was marked reserved, pending its first READY advertisement
+	reserved map[key]time.Time
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rejected: newCounterVec("warden_requests_rejected_total",
+			"Requests that were rejected or failed, by request type and gRPC status code", "type", "code"),
+		sendErrors: newCounterVec("warden_stream_send_errors_total",
+			"Advertisements that could not be sent to a client stream"),
+		provisioning: newHistogramVec("warden_provisioning_seconds",
+			"Time from a cluster being reserved to it being ready, by cluster type", provisioningBuckets, "cluster_type"),
+		reservations: newHistogramVec("warden_reservation_held_seconds",
+			"Time for which reservations were held before they ended, by cluster type", reservationBuckets, "cluster_type"),
+		requested: newHistogramVec("warden_reservation_requested_seconds",
+			"Durations requested by reservations with a limited duration, by cluster type", reservationBuckets, "cluster_type"),
+		reserved: make(map[key]time.Time),
+	}
+}
+
+// Records the server's rejection of a request, or its failure reported by an agent
+func (m *metrics) requestRejected(t warden.ClusterRequest_RequestType, code codes.Code) {
+	m.rejected.inc(t.String(), code.String())
+}
+
+// Records the reservation of a cluster by the server
+func (m *metrics) clusterReserved(k key, req *warden.ClusterRequest) {
+	m.reserved[k] = time.Now()
+	if req.Duration > 0 {
+		m.requested.observe(float64(req.Duration)*60, k.cType)
+	}
+}
+
+// Records the transition of a cluster from its previous advertisement to the next one, if any
+func (m *metrics) clusterUpdated(k key, prev, next *warden.ClusterAdvertisement) {
+	if start, ok := m.reserved[k]; ok {
+		if next != nil && next.State == warden.ClusterAdvertisement_READY {
+			m.provisioning.observe(time.Since(start).Seconds(), k.cType)
+		}
+		if next == nil || next.State != warden.ClusterAdvertisement_RESERVED {
+			delete(m.reserved, k)
+		}
+	}
+	if prev == nil || prev.ReservationInfo == nil {
+		return
+	}
+	if next == nil || next.ReservationInfo == nil ||
+		next.ReservationInfo.ReservationStartTime != prev.ReservationInfo.ReservationStartTime {
+		held := time.Since(time.Unix(prev.ReservationInfo.ReservationStartTime, 0))
+		m.reservations.observe(held.Seconds(), k.cType)
+	}
+}
+
+// GET /metrics: serves the metrics in the Prometheus text format
+func (s *wardenServer) httpMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writeMetrics(w)
+}
+
+func (s *wardenServer) writeMetrics(w io.Writer) {
+	// Note: callers must hold s.lock
+	clusters := newGaugeVec("warden_clusters", "Clusters known to the server, by cluster type and state",
+		"cluster_type", "state")
+	for _, cl := range s.clusters {
+		// report every state of each type, so that empty states read as zero rather than missing
+		for i := range warden.ClusterAdvertisement_State_name {
+			clusters.add(0, cl.ad.ClusterType, warden.ClusterAdvertisement_State(i).String())
+		}
+	}
+	for _, cl := range s.clusters {
+		clusters.add(1, cl.ad.ClusterType, cl.ad.State.String())
+	}
+	clusters.write(w)
+
+	queue := newGaugeVec("warden_queue_depth", "Reserve requests waiting for a cluster")
+	queue.add(float64(s.queue.Len()))
+	queue.write(w)
+
+	agents := newGaugeVec("warden_agents", "Connected agents")
+	agents.add(float64(len(s.agents)))
+	agents.write(w)
+
+	clients := newGaugeVec("warden_clients", "Connected client streams")
+	clients.add(float64(len(s.clients)))
+	clients.write(w)
+
+	s.metrics.rejected.write(w)
+	s.metrics.sendErrors.write(w)
+	s.metrics.provisioning.write(w)
+	s.metrics.reservations.write(w)
+	s.metrics.requested.write(w)
+}
+
+// Set of series of one metric, keyed by their label values
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+}
+
+func (v *metricVec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Returns the label set of a series, e.g. {type="RESERVE",code="NotFound"}; extra is appended as is
+func (v *metricVec) labelSet(values []string, extra string) string {
+	var pairs []string
+	for i, l := range v.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, labelEscaper.Replace(values[i])))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+const labelSep = "\xff"
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counterVec struct {
+	metricVec
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{metricVec{name, help, "counter", labels}, make(map[string]float64)}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.values[strings.Join(values, labelSep)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.header(w)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelSet(strings.Split(k, labelSep), ""), formatValue(c.values[k]))
+	}
+}
+
+// Gauges are computed when scraped, so they share the representation of counters
+type gaugeVec struct {
+	counterVec
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{counterVec{metricVec{name, help, "gauge", labels}, make(map[string]float64)}}
+}
+
+func (g *gaugeVec) add(delta float64, values ...string) {
+	g.values[strings.Join(values, labelSep)] += delta
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	metricVec
+	buckets []float64
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{metricVec{name, help, "histogram", labels}, buckets, make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	k := strings.Join(values, labelSep)
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.header(w)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s, values := h.series[k], strings.Split(k, labelSep)
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelSet(values, `le="`+formatValue(b)+`"`), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelSet(values, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelSet(values, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelSet(values, ""), s.count)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc/codes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	k := key{"a", "dummy"}
+	start := time.Now().Add(-90 * time.Minute).Unix()
+	reserved := &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy",
+		State: warden.ClusterAdvertisement_RESERVED, RequestId: "tom"}
+	ready := &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy",
+		State: warden.ClusterAdvertisement_READY, RequestId: "tom",
+		ReservationInfo: &warden.ClusterAdvertisement_ReservationInfo{UserName: "tom", Duration: 120, ReservationStartTime: start}}
+	available := &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy",
+		State: warden.ClusterAdvertisement_AVAILABLE}
+
+	s.clusters[k] = cluster{ad: ready}
+	s.metrics.clusterReserved(k, &warden.ClusterRequest{RequestId: "tom", Duration: 120})
+	s.metrics.clusterUpdated(k, reserved, ready)
+	s.metrics.clusterUpdated(k, ready, available)
+	s.metrics.requestRejected(warden.ClusterRequest_EXTEND, codes.PermissionDenied)
+	s.metrics.sendErrors.inc()
+
+	var b bytes.Buffer
+	s.writeMetrics(&b)
+	out := b.String()
+	for _, line := range []string{
+		`warden_clusters{cluster_type="dummy",state="READY"} 1`,
+		`warden_clusters{cluster_type="dummy",state="AVAILABLE"} 0`,
+		`warden_queue_depth 0`,
+		`warden_requests_rejected_total{type="EXTEND",code="PermissionDenied"} 1`,
+		`warden_stream_send_errors_total 1`,
+		`warden_provisioning_seconds_bucket{cluster_type="dummy",le="5"} 1`,
+		`warden_provisioning_seconds_count{cluster_type="dummy"} 1`,
+		`warden_reservation_held_seconds_bucket{cluster_type="dummy",le="3600"} 0`,
+		`warden_reservation_held_seconds_bucket{cluster_type="dummy",le="7200"} 1`,
+		`warden_reservation_requested_seconds_sum{cluster_type="dummy"} 7200`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Reservation event delivered to its holder outside of the warden's streams
+type notification struct {
+	User        string    `json:"user"`
+	RequestId   string    `json:"requestId"`
+	ClusterId   string    `json:"clusterId"`
+	ClusterType string    `json:"clusterType"`
+	Expires     time.Time `json:"expires"`
+	Message     string    `json:"message"`
+}
+
+// Delivers notifications to reservation holders, e.g. so that they can extend in time
+type notifier interface {
+	Notify(n notification) error
+}
+
+// Posts notifications as JSON to a URL
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookNotifier) Notify(n notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s returned %s", w.url, resp.Status)
+	}
+	return nil
+}
+
+// Mails notifications to <user>@<domain> through an SMTP relay
+type smtpNotifier struct {
+	addr   string
+	from   string
+	domain string
+}
+
+func (m *smtpNotifier) Notify(n notification) error {
+	if n.User == "" {
+		return fmt.Errorf("reservation %s has no user to mail", n.RequestId)
+	}
+	to := n.User + "@" + m.domain
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [warden] %s\r\n\r\n"+
+		"Cluster %s (%s) of reservation %s expires at %s.\r\n"+
+		"Extend the reservation to keep it.\r\n",
+		m.from, to, n.Message, n.ClusterId, n.ClusterType, n.RequestId, n.Expires.Format(time.RFC1123))
+	return smtp.SendMail(m.addr, nil, m.from, []string{to}, []byte(msg))
+}
+
+// Delivers notifications through each of its notifiers
+type multiNotifier []notifier
+
+func (l multiNotifier) Notify(n notification) error {
+	var errs []string
+	for _, x := range l {
+		if err := x.Notify(n); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Returns the notifier for the given settings, or nil if none is configured
+func newNotifier(webhook, smtpAddr, from, domain string) (notifier, error) {
+	var l multiNotifier
+	if webhook != "" {
+		l = append(l, &webhookNotifier{webhook, &http.Client{Timeout: 10 * time.Second}})
+	}
+	if smtpAddr != "" {
+		if domain == "" {
+			return nil, fmt.Errorf("a mail domain is required to mail notifications")
+		}
+		l = append(l, &smtpNotifier{smtpAddr, from, domain})
+	}
+	if len(l) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// Warns the holder of the reservation that it ends soon, on the client streams and through the notifier
+func (s *wardenServer) warnHolder(cl *cluster, end time.Time) {
+	// Note: callers must hold s.lock
+	left := end.Sub(time.Now()).Round(time.Second)
+	w := *cl.ad
+	w.Event = &warden.ClusterAdvertisement_Event{
+		Type:    warden.ClusterAdvertisement_Event_EXPIRING,
+		Reason:  warden.ClusterAdvertisement_Event_EXPIRED,
+		Message: fmt.Sprintf("reservation %s expires in %v", cl.ad.RequestId, left),
+	}
+	s.sendUpdate(&w)
+	n := notification{
+		RequestId:   cl.ad.RequestId,
+		ClusterId:   cl.ad.ClusterId,
+		ClusterType: cl.ad.ClusterType,
+		Expires:     end,
+		Message:     w.Event.Message,
+	}
+	if info := cl.ad.ReservationInfo; info != nil {
+		n.User = info.UserName
+	}
+	s.notify(n)
+}
+
+func (s *wardenServer) notify(n notification) {
+	// Note: callers must hold s.lock
+	if s.notifier == nil {
+		return
+	}
+	// Deliver in the background, so that a slow endpoint does not hold up the server
+	go func() {
+		if err := s.notifier.Notify(n); err != nil {
+			fmt.Printf("Failed to notify %s about %s: %v\n", n.User, n.RequestId, err)
+		}
+	}()
+}
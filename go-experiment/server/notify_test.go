@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	got := make(chan notification, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		got <- n
+	}))
+	defer ts.Close()
+
+	nf, err := newNotifier(ts.URL, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := notification{User: "tom", RequestId: "tom", ClusterId: "a", ClusterType: "dummy",
+		Expires: time.Unix(1000000, 0).UTC(), Message: "reservation tom expires in 5m0s"}
+	if err := nf.Notify(sent); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-got; n != sent {
+		t.Errorf("Expected %+v, got %+v", sent, n)
+	}
+
+	if _, err := newNotifier("", "localhost:25", "warden@localhost", ""); err == nil {
+		t.Error("Expected an error when mailing without a domain")
+	}
+	if nf, _ := newNotifier("", "", "", ""); nf != nil {
+		t.Error("Expected no notifier when none is configured")
+	}
+}
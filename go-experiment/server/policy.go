@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"os"
+	"time"
+)
+
+// Limits on reservations; zero values mean unlimited
+type policy struct {
+	// longest duration in minutes that may be requested at once, by cluster type; "*" applies to
+	// types without their own limit
+	MaxDuration map[string]int32 `json:"maxDuration"`
+	// most reservations a user may hold or wait for at the same time
+	MaxReservations int `json:"maxReservations"`
+	// most cell-hours a user may reserve per day
+	MaxCellHoursPerDay float64 `json:"maxCellHoursPerDay"`
+}
+
+// Reads the policy from a JSON file; an empty path yields a policy without limits
+func loadPolicy(path string) (*policy, error) {
+	p := new(policy)
+	if path == "" {
+		return p, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *policy) maxDuration(cType string) (int32, bool) {
+	if max, ok := p.MaxDuration[cType]; ok {
+		return max, true
+	}
+	max, ok := p.MaxDuration["*"]
+	return max, ok
+}
+
+// Returns true if the duration may be requested for clusters of the given type
+func (p *policy) allowsDuration(cType string, d int32) bool {
+	max, ok := p.maxDuration(cType)
+	return !ok || (d >= 0 && d <= max)
+}
+
+// Cell-hours reserved by a user on a given day
+type usage struct {
+	day   string
+	hours float64
+}
+
+func today() string {
+	return time.Now().Format("2006-01-02")
+}
+
+// Returns the hours covered by a duration in minutes; indefinite durations are not counted
+func durationHours(d int32) float64 {
+	if d < 0 {
+		return 0
+	}
+	return float64(d) / 60
+}
+
+func (s *wardenServer) cellHours(user string) float64 {
+	// Note: callers must hold s.lock
+	u, ok := s.usage[user]
+	if !ok || u.day != today() {
+		return 0
+	}
+	return u.hours
+}
+
+// Adds (or, if negative, refunds) cell-hours to the user's usage for the day
+func (s *wardenServer) chargeCellHours(user string, hours float64) {
+	// Note: callers must hold s.lock
+	if user == "" || hours == 0 {
+		return
+	}
+	u, ok := s.usage[user]
+	if !ok || u.day != today() {
+		u = &usage{day: today()}
+		s.usage[user] = u
+	}
+	u.hours += hours
+	if u.hours < 0 {
+		u.hours = 0
+	}
+}
+
+// Cell-hours charged to a user for a request that its agent has yet to carry out
+type charge struct {
+	user  string
+	hours float64
+}
+
+// Charges the user for the request, and remembers the charge until the agent carries the request out
+func (s *wardenServer) chargeRequest(rId, user string, hours float64) {
+	// Note: callers must hold s.lock
+	s.chargeCellHours(user, hours)
+	s.charges[rId] = charge{user, hours}
+}
+
+// Gives back the charge of a request that its agent could not carry out
+func (s *wardenServer) refundRequest(rId string) {
+	// Note: callers must hold s.lock
+	if c, ok := s.charges[rId]; ok {
+		s.chargeCellHours(c.user, -c.hours)
+		delete(s.charges, rId)
+	}
+}
+
+// Returns the number of reservations the user holds or is waiting for, other than the given request
+func (s *wardenServer) reservationCount(user, except string) int {
+	// Note: callers must hold s.lock
+	n := 0
+	for rId := range s.requests {
+		if owner, ok := s.requestOwner(rId); ok && owner == user && rId != except {
+			n++
+		}
+	}
+	for _, e := range s.queue.entries {
+		if e.req.Spec != nil && e.req.Spec.UserName == user && e.req.RequestId != except {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the hours left of the cluster's reservation
+func remainingHours(ad *warden.ClusterAdvertisement) float64 {
+	end, ok := reservationEnd(ad)
+	if !ok {
+		return 0
+	}
+	left := end.Sub(time.Now()).Hours()
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// Returns an error if a new reservation would exceed the user's limits
+func (s *wardenServer) checkReservePolicy(req *warden.ClusterRequest) error {
+	// Note: callers must hold s.lock
+	p := s.policy
+	var user string
+	if req.Spec != nil {
+		user = req.Spec.UserName
+	}
+	if req.ClusterType != "" && !p.allowsDuration(req.ClusterType, req.Duration) {
+		max, _ := p.maxDuration(req.ClusterType)
+		return grpc.Errorf(codes.InvalidArgument, "Duration %d of req %s exceeds the limit of %d minutes for %s clusters",
+			req.Duration, req.RequestId, max, req.ClusterType)
+	}
+	if p.MaxReservations > 0 {
+		if n := s.reservationCount(user, req.RequestId); n >= p.MaxReservations {
+			return grpc.Errorf(codes.ResourceExhausted, "%s already holds or waits for %d of at most %d reservations",
+				user, n, p.MaxReservations)
+		}
+	}
+	if p.MaxCellHoursPerDay > 0 {
+		if req.Duration < 0 {
+			return grpc.Errorf(codes.InvalidArgument, "Req %s must have a duration; usage is limited to %v cell-hours per day",
+				req.RequestId, p.MaxCellHoursPerDay)
+		}
+		if used := s.cellHours(user); used+durationHours(req.Duration) > p.MaxCellHoursPerDay {
+			return grpc.Errorf(codes.ResourceExhausted, "Req %s for %d minutes exceeds the daily limit of %v cell-hours for %s (%.1f used)",
+				req.RequestId, req.Duration, p.MaxCellHoursPerDay, user, used)
+		}
+	}
+	return nil
+}
+
+// Returns an error if extending the cluster's reservation would exceed the holder's limits
+func (s *wardenServer) checkExtendPolicy(cl *cluster, req *warden.ClusterRequest) error {
+	// Note: callers must hold s.lock
+	p := s.policy
+	if !p.allowsDuration(cl.ad.ClusterType, req.Duration) {
+		max, _ := p.maxDuration(cl.ad.ClusterType)
+		return grpc.Errorf(codes.InvalidArgument, "Extension of req %s by %d minutes exceeds the limit of %d minutes for %s clusters",
+			req.RequestId, req.Duration, max, cl.ad.ClusterType)
+	}
+	if p.MaxCellHoursPerDay > 0 && cl.ad.ReservationInfo != nil {
+		user := cl.ad.ReservationInfo.UserName
+		if req.Duration < 0 {
+			return grpc.Errorf(codes.InvalidArgument, "Req %s cannot be extended indefinitely; usage is limited to %v cell-hours per day",
+				req.RequestId, p.MaxCellHoursPerDay)
+		}
+		extra := durationHours(req.Duration) - remainingHours(cl.ad)
+		if used := s.cellHours(user); extra > 0 && used+extra > p.MaxCellHoursPerDay {
+			return grpc.Errorf(codes.ResourceExhausted, "Extending req %s by %d minutes exceeds the daily limit of %v cell-hours for %s (%.1f used)",
+				req.RequestId, req.Duration, p.MaxCellHoursPerDay, user, used)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"testing"
+)
+
+func TestReservePolicy(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	s.policy = &policy{
+		MaxDuration:        map[string]int32{"ec2": 60, "*": 240},
+		MaxReservations:    1,
+		MaxCellHoursPerDay: 3,
+	}
+	if s.policy.allowsDuration("ec2", 120) || !s.policy.allowsDuration("dummy", 120) || s.policy.allowsDuration("dummy", -1) {
+		t.Error("Unexpected duration limits")
+	}
+
+	req := func(rId, cType string, d int32) *warden.ClusterRequest {
+		return &warden.ClusterRequest{RequestId: rId, ClusterType: cType, Duration: d,
+			Spec: &warden.ClusterRequest_Spec{UserName: "tom"}}
+	}
+	if err := s.checkReservePolicy(req("a", "ec2", 120)); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a long ec2 reservation, got %v", err)
+	}
+	if err := s.checkReservePolicy(req("a", "dummy", 240)); grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted beyond the daily cell-hours, got %v", err)
+	}
+	if err := s.checkReservePolicy(req("a", "dummy", 120)); err != nil {
+		t.Errorf("Expected reservation to be allowed, got %v", err)
+	}
+
+	s.queue.push(req("a", "dummy", 120))
+	if err := s.checkReservePolicy(req("b", "dummy", 30)); grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted beyond the concurrent reservations, got %v", err)
+	}
+	s.queue.remove(0)
+
+	s.chargeCellHours("tom", 2.5)
+	if err := s.checkReservePolicy(req("b", "dummy", 60)); grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted after using the day's cell-hours, got %v", err)
+	}
+	s.chargeCellHours("tom", -1)
+	if err := s.checkReservePolicy(req("b", "dummy", 60)); err != nil {
+		t.Errorf("Expected refunded cell-hours to be available, got %v", err)
+	}
+}
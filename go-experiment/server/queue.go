@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"sort"
+)
+
+// A reserve request waiting for a cluster to become available
+type queued struct {
+	req     *warden.ClusterRequest
+	seq     uint64
+	waiters []chan *warden.ClusterAdvertisement
+}
+
+// Queue of reserve requests ordered by priority (highest first) and then by arrival
+type waitQueue struct {
+	entries []*queued
+	nextSeq uint64
+}
+
+func (q *waitQueue) Len() int      { return len(q.entries) }
+func (q *waitQueue) Swap(i, j int) { q.entries[i], q.entries[j] = q.entries[j], q.entries[i] }
+func (q *waitQueue) Less(i, j int) bool {
+	a, b := q.entries[i], q.entries[j]
+	if a.req.Priority != b.req.Priority {
+		return a.req.Priority > b.req.Priority
+	}
+	return a.seq < b.seq
+}
+
+// Returns the index of the queued request with the given id, or -1 if it is not queued
+func (q *waitQueue) find(rId string) int {
+	for i, e := range q.entries {
+		if e.req.RequestId == rId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *waitQueue) push(req *warden.ClusterRequest) *queued {
+	e := &queued{req: req, seq: q.nextSeq}
+	q.nextSeq++
+	q.entries = append(q.entries, e)
+	sort.Stable(q)
+	return e
+}
+
+func (q *waitQueue) remove(i int) *queued {
+	e := q.entries[i]
+	q.entries = append(q.entries[:i], q.entries[i+1:]...)
+	return e
+}
+
+// Builds the advertisement sent to clients for a queued request at the given index
+func (q *waitQueue) advertisement(i int) *warden.ClusterAdvertisement {
+	req := q.entries[i].req
+	ad := &warden.ClusterAdvertisement{
+		ClusterId:     req.ClusterId,
+		ClusterType:   req.ClusterType,
+		State:         warden.ClusterAdvertisement_QUEUED,
+		RequestId:     req.RequestId,
+		QueuePosition: uint32(i + 1),
+	}
+	if req.Spec != nil {
+		ad.ReservationInfo = &warden.ClusterAdvertisement_ReservationInfo{
+			UserName: req.Spec.UserName,
+			Duration: req.Duration,
+		}
+	}
+	return ad
+}
+
+func (s *wardenServer) enqueue(req *warden.ClusterRequest) (wait chan *warden.ClusterAdvertisement) {
+	// Note: callers must hold s.lock
+	wait = make(chan *warden.ClusterAdvertisement, 1)
+	i := s.queue.find(req.RequestId)
+	if i < 0 {
+		s.queue.push(req)
+		i = s.queue.find(req.RequestId)
+		fmt.Printf("Queued request %s at position %d\n", req.RequestId, i+1)
+		s.sendQueueUpdates()
+	}
+	e := s.queue.entries[i]
+	e.waiters = append(e.waiters, wait)
+	return wait
+}
+
+func (s *wardenServer) dequeue(rId string) (*warden.ClusterAdvertisement, bool) {
+	// Note: callers must hold s.lock
+	i := s.queue.find(rId)
+	if i < 0 {
+		return nil, false
+	}
+	ad := s.queue.advertisement(i)
+	e := s.queue.remove(i)
+	failWaiters(e.waiters, failureAd(nil, key{ad.ClusterId, ad.ClusterType}, rId, codes.Canceled,
+		fmt.Sprintf("Request %s left the queue", rId)))
+	fmt.Println("Removed request from queue:", rId)
+	s.sendWithdrawal(ad, warden.ClusterAdvertisement_Event_RETURNED, "request left the queue")
+	s.sendQueueUpdates()
+	return ad, true
+}
+
+func (s *wardenServer) queuedStatus(rId string) (wait chan *warden.ClusterAdvertisement, ok bool) {
+	// Note: callers must hold s.lock
+	i := s.queue.find(rId)
+	if i < 0 {
+		return nil, false
+	}
+	wait = make(chan *warden.ClusterAdvertisement, 1)
+	wait <- s.queue.advertisement(i)
+	return wait, true
+}
+
+// Assigns available clusters to queued requests, in queue order
+func (s *wardenServer) drainQueue() {
+	// Note: callers must hold s.lock
+	changed := false
+	for i := 0; i < len(s.queue.entries); {
+		e := s.queue.entries[i]
+		// the user's usage may have changed while the request was waiting
+		if err := s.checkReservePolicy(e.req); err != nil {
+			ad := s.queue.advertisement(i)
+			s.queue.remove(i)
+			changed = true
+			fmt.Printf("Queued request %s no longer fits the policy: %v\n", e.req.RequestId, err)
+			s.metrics.requestRejected(e.req.Type, grpc.Code(err))
+			failWaiters(e.waiters, errorAd(nil, key{ad.ClusterId, ad.ClusterType}, e.req.RequestId, err))
+			s.sendWithdrawal(ad, warden.ClusterAdvertisement_Event_RETURNED, "request left the queue")
+			continue
+		}
+		cl, found := s.assignRequest(e.req)
+		if !found {
+			i++
+			continue
+		}
+		s.queue.remove(i)
+		changed = true
+		err := s.forwardRequest(cl, e.req)
+		if err != nil {
+			fmt.Printf("Unable to forward queued request %s: %v\n", e.req.RequestId, err)
+			for _, ch := range e.waiters {
+				s.notifyWhenReady(cl, e.req.RequestId, ch)
+			}
+			// release the cluster, refund the charge and fail the waiters, as if the agent had rejected the request
+			s.requestFailed(cl.agent, &warden.RequestAck{
+				RequestId:   e.req.RequestId,
+				ClusterId:   cl.ad.ClusterId,
+				ClusterType: cl.ad.ClusterType,
+				Type:        e.req.Type,
+				Phase:       warden.RequestAck_REJECTED,
+				Code:        uint32(grpc.Code(err)),
+				Message:     grpc.ErrorDesc(err),
+			})
+			continue
+		}
+		for _, ch := range e.waiters {
+			s.notifyWhenReady(cl, e.req.RequestId, ch)
+		}
+	}
+	if changed {
+		s.sendQueueUpdates()
+	}
+}
+
+// Sends the current position of every queued request to all streaming clients
+func (s *wardenServer) sendQueueUpdates() {
+	// Note: callers must hold s.lock
+	for i := range s.queue.entries {
+		s.sendUpdate(s.queue.advertisement(i))
+	}
+}
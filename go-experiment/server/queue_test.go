@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"testing"
+)
+
+func TestWaitQueueOrder(t *testing.T) {
+	var q waitQueue
+	for _, r := range []struct {
+		rId      string
+		priority int32
+	}{{"a", 0}, {"b", 1}, {"c", 0}, {"d", 1}, {"e", -1}} {
+		q.push(&warden.ClusterRequest{RequestId: r.rId, Priority: r.priority})
+	}
+
+	// higher priorities go first, and requests of the same priority in the order they came in
+	expected := []string{"b", "d", "a", "c", "e"}
+	for i, rId := range expected {
+		if ad := q.advertisement(i); ad.RequestId != rId || ad.QueuePosition != uint32(i+1) {
+			t.Errorf("Expected %s at position %d, got %s at %d", rId, i+1, ad.RequestId, ad.QueuePosition)
+		}
+	}
+
+	q.remove(q.find("d"))
+	q.push(&warden.ClusterRequest{RequestId: "d", Priority: 1})
+	if i := q.find("d"); i != 1 {
+		t.Errorf("Expected d to go behind b after queueing again, got position %d", i+1)
+	}
+}
+
+func TestDrainQueueSkipsUnfit(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	agent := &agentConn{stream: &sendingAgentStream{}, reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	ad := func(cId string, nodes uint32, state warden.ClusterAdvertisement_State, rId string) *warden.ClusterAdvertisement {
+		return &warden.ClusterAdvertisement{ClusterId: cId, ClusterType: "dummy", State: state, RequestId: rId,
+			Capacity: &warden.ClusterAdvertisement_Capacity{MaxControllerNodes: nodes}}
+	}
+	s.clusters[key{"small", "dummy"}] = cluster{agent: agent, ad: ad("small", 3, warden.ClusterAdvertisement_READY, "x")}
+	s.clusters[key{"big", "dummy"}] = cluster{agent: agent, ad: ad("big", 5, warden.ClusterAdvertisement_READY, "y")}
+
+	// the head of the queue needs the big cluster, which stays reserved
+	reqs := []*warden.ClusterRequest{
+		{RequestId: "tom", Type: warden.ClusterRequest_RESERVE, Priority: 1, Spec: &warden.ClusterRequest_Spec{ControllerNodes: 5}},
+		{RequestId: "ann", Type: warden.ClusterRequest_RESERVE, Spec: &warden.ClusterRequest_Spec{ControllerNodes: 3}},
+	}
+	for _, req := range reqs {
+		s.enqueue(req)
+	}
+	s.updateCluster(&cluster{agent: agent, ad: ad("small", 3, warden.ClusterAdvertisement_AVAILABLE, "")})
+
+	if cl := s.clusters[key{"small", "dummy"}]; cl.ad.RequestId != "ann" || cl.ad.State != warden.ClusterAdvertisement_RESERVED {
+		t.Errorf("Expected ann to be assigned the small cluster past tom, got %v", cl.ad)
+	}
+	if len(s.queue.entries) != 1 || s.queue.find("tom") != 0 {
+		t.Errorf("Expected tom to keep waiting at the head of the queue, got %v", s.queue.entries)
+	}
+}
+
+func TestDrainQueueChecksPolicy(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	s.policy = &policy{MaxCellHoursPerDay: 3}
+	agent := &agentConn{stream: &sendingAgentStream{}, reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	reqs := []*warden.ClusterRequest{
+		{RequestId: "tom", Type: warden.ClusterRequest_RESERVE, Priority: 1, Duration: 120,
+			Spec: &warden.ClusterRequest_Spec{UserName: "tom"}},
+		{RequestId: "ann", Type: warden.ClusterRequest_RESERVE, Duration: 120,
+			Spec: &warden.ClusterRequest_Spec{UserName: "ann"}},
+	}
+	tom := s.enqueue(reqs[0])
+	s.enqueue(reqs[1])
+
+	// tom used up the day's hours elsewhere while waiting, so ann gets the cluster instead
+	s.chargeCellHours("tom", 2)
+	s.updateCluster(&cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}})
+
+	select {
+	case ad := <-tom:
+		if err := replyError("tom", ad); grpc.Code(err) != codes.ResourceExhausted {
+			t.Errorf("Expected tom's request to fail the policy, got %v", err)
+		}
+	default:
+		t.Error("Expected tom's waiter to be failed")
+	}
+	if cl := s.clusters[key{"a", "dummy"}]; cl.ad.RequestId != "ann" {
+		t.Errorf("Expected ann to be assigned the cluster, got %v", cl.ad)
+	}
+	if len(s.queue.entries) != 0 {
+		t.Errorf("Expected the queue to be empty, got %v", s.queue.entries)
+	}
+	if used := s.cellHours("tom"); used != 2 {
+		t.Errorf("Expected tom not to be charged for the rejected request, got %v", used)
+	}
+}
+
+func TestDrainQueueForwardFails(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	stream := &sendingAgentStream{err: grpc.Errorf(codes.Unavailable, "stream closed")}
+	agent := &agentConn{stream: stream, reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	tom := s.enqueue(&warden.ClusterRequest{RequestId: "tom", Type: warden.ClusterRequest_RESERVE, Duration: 120,
+		Spec: &warden.ClusterRequest_Spec{UserName: "tom"}})
+	s.updateCluster(&cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}})
+
+	select {
+	case ad := <-tom:
+		if err := replyError("tom", ad); grpc.Code(err) != codes.Unavailable {
+			t.Errorf("Expected tom's request to fail, got %v", err)
+		}
+	default:
+		t.Error("Expected tom's waiter to be failed")
+	}
+	if cl := s.clusters[key{"a", "dummy"}]; cl.ad.State != warden.ClusterAdvertisement_AVAILABLE || cl.ad.RequestId != "" {
+		t.Errorf("Expected the cluster to be released, got %v", cl.ad)
+	}
+	if _, ok := s.requests["tom"]; ok {
+		t.Error("Expected tom's request to be forgotten")
+	}
+	if used := s.cellHours("tom"); used != 0 {
+		t.Errorf("Expected the charge to be refunded, got %v", used)
+	}
+	if len(s.queue.entries) != 0 || len(s.waiters) != 0 {
+		t.Errorf("Expected nothing left waiting, got %v and %v", s.queue.entries, s.waiters)
+	}
+}
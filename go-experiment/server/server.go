@@ -1,22 +1,35 @@
 package main
 
 import (
+	"crypto/x509"
+	"flag"
 	"fmt"
+	"github.com/opennetworkinglab/onos-warden/util"
 	"github.com/opennetworkinglab/onos-warden/warden"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/peer"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
-	"errors"
 )
 
 type cluster struct {
 	ad    *warden.ClusterAdvertisement
-	agent warden.ClusterAgentService_AgentClustersServer
+	agent *agentConn
+
+	// time at which the agent disconnected; zero while the agent is connected
+	staleSince time.Time
+}
+
+// Channel of a request waiting for its cluster to be ready
+type waiter struct {
+	rId string
+	ch  chan *warden.ClusterAdvertisement
 }
 
 type request struct {
@@ -47,15 +60,78 @@ type wardenServer struct {
 
 	// mapping from RequestId to key(ClusterId, ClusterType)
 	requests map[string]key
+	// mapping from RequestId of assigned requests to the user that made them, which holds the
+	// reservation until the agent advertises it
+	owners map[string]string
 
-	// registries of client and agent streams
-	clients map[warden.ClusterClientService_ServerClustersServer]bool
-	agents  map[warden.ClusterAgentService_AgentClustersServer]bool
+	// registries of client streams and agents (by name)
+	clients map[recvAd]bool
+	agents  map[string]*agentConn
 
 	// registries of channels waiting for a cluster to be ready
-	waiters map[key][]chan *warden.ClusterAdvertisement
+	waiters map[key][]waiter
+
+	// persistent journal of cluster transitions
+	store stateStore
+
+	// cluster state restored from the journal, pending the first advertisement from its agent
+	restored map[key]*warden.ClusterAdvertisement
+
+	// reserve requests waiting for a cluster to become available
+	queue waitQueue
+
+	// CAs that issue the certificates of agents and of users; agents need not present a
+	// certificate if agentCAs is nil, i.e. when the server runs without TLS
+	agentCAs *x509.CertPool
+	userCAs  *x509.CertPool
+
+	// true if clients must identify themselves with a certificate or a token
+	userAuth bool
+	// mapping from token to user name
+	tokens map[string]string
+	// users that may act on any reservation
+	admins map[string]bool
+
+	// time to wait for a disconnected agent to return before its clusters are removed
+	agentGrace time.Duration
+
+	// deadlines of the current reservations, and the timer that fires at the earliest one
+	expiry      *expiryScheduler
+	expiryTimer *time.Timer
+	// called with s.lock held when the holder of a reservation is due a warning of its end
+	expiryWarning func(cl *cluster, end time.Time)
+
+	// optional delivery of warnings outside of the client streams
+	notifier notifier
+
+	// limits on reservations, and the cell-hours reserved by each user today
+	policy *policy
+	usage  map[string]*usage
+	// charges of requests that agents have yet to carry out, by RequestId
+	charges map[string]charge
+
+	// mapping from RequestId of session-bound requests to the client stream they were made over
+	sessions map[string]warden.ClusterClientService_ServerClustersServer
+	// time to wait for a client to return before the requests bound to its closed stream are released
+	sessionGrace time.Duration
+
+	// requests forwarded to agents that have yet to acknowledge them, by RequestId
+	pendingAcks map[string]*pendingAck
+	// returned reservations whose withdrawal is sent once their agent takes the return on
+	returns map[string]key
+	// time to wait for an agent to acknowledge a request before it is failed
+	ackTimeout time.Duration
+
+	// counters and histograms exposed at /metrics
+	metrics *metrics
+
+	// append-only log of requests and cluster transitions, queried by History
+	auditLog auditLog
 }
 
+// Time to wait for agents to re-advertise restored clusters before their reservations are dropped
+const restoreWindow = 2 * time.Minute
+
 func keyFromCluster(cl *cluster) key {
 	return key{cl.ad.ClusterId, cl.ad.ClusterType}
 }
@@ -85,14 +161,32 @@ func logConn(ctx context.Context, a, t string, o interface{}) {
 
 func (s *wardenServer) Request(ctx context.Context, req *warden.ClusterRequest) (ad *warden.ClusterAdvertisement, err error) {
 	logClient(ctx, "New request from", req)
-	wait, err := s.processRequest(req)
+	id, err := s.identify(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.handleRequest(ctx, id, req)
+}
+
+// Processes the request and waits for its reply, or for the caller to go away
+func (s *wardenServer) handleRequest(ctx context.Context, id identity, req *warden.ClusterRequest) (ad *warden.ClusterAdvertisement, err error) {
+	wait, err := s.processRequest(id, req, nil)
 	if err != nil {
 		fmt.Printf("Error processing request %v\n%v\n", req, err)
 		return nil, err
 	}
-	ad = <-wait
-	if ad == nil {
-		return nil, errors.New("Unable to process request")
+	select {
+	case ad = <-wait:
+	case <-ctx.Done():
+		// client has gone away; give up its place in the queue, if it has one
+		s.lock.Lock()
+		s.dequeue(req.RequestId)
+		s.lock.Unlock()
+		return nil, ctx.Err()
+	}
+	if err := replyError(req.RequestId, ad); err != nil {
+		logClient(ctx, "Request failed from", err)
+		return nil, err
 	}
 	logClient(ctx, "Sending ad to", ad)
 	return ad, nil
@@ -120,6 +214,11 @@ func (s *wardenServer) List(_ *warden.Empty, stream warden.ClusterClientService_
 
 func (s *wardenServer) ServerClusters(stream warden.ClusterClientService_ServerClustersServer) error {
 	logClient(stream.Context(), "New stream from", nil)
+	id, err := s.identify(stream.Context())
+	if err != nil {
+		logClient(stream.Context(), "Rejecting stream from", err)
+		return err
+	}
 	s.lock.Lock()
 	// register the stream so that we can send it new information to all active client
 	s.clients[stream] = true
@@ -129,10 +228,10 @@ func (s *wardenServer) ServerClusters(stream warden.ClusterClientService_ServerC
 		s.lock.Lock()
 		defer s.lock.Unlock()
 		delete(s.clients, stream)
-		//FIXME revoke all duration == -1 requests if client disconnects
+		s.closeSession(stream)
 	}()
 
-	err := s.sendSnapshot(stream)
+	err = s.sendSnapshot(stream)
 	s.lock.Unlock()
 	if err != nil {
 		return err
@@ -149,7 +248,20 @@ func (s *wardenServer) ServerClusters(stream warden.ClusterClientService_ServerC
 			logClient(stream.Context(), "Connection error from", err)
 			return err
 		}
-		go s.processRequest(req)
+		go func(req *warden.ClusterRequest) {
+			_, err := s.processRequest(id, req, stream)
+			if err != nil {
+				logClient(stream.Context(), "Error processing request from", err)
+				// tell the client why, since there is no reply to carry the error
+				s.lock.Lock()
+				defer s.lock.Unlock()
+				k := key{req.ClusterId, req.ClusterType}
+				if serr := stream.Send(errorAd(nil, k, req.RequestId, err)); serr != nil {
+					logClient(stream.Context(), "Error sending failure to", serr)
+				}
+				return
+			}
+		}(req)
 	}
 	return nil
 }
@@ -159,6 +271,7 @@ func (s *wardenServer) sendUpdate(ad *warden.ClusterAdvertisement) {
 	for c := range s.clients {
 		err := c.Send(ad)
 		if err != nil {
+			s.metrics.sendErrors.inc()
 			logClient(c.Context(), "Error sending update to", err)
 		} else {
 			logClient(c.Context(), "Sent update to", ad)
@@ -166,15 +279,115 @@ func (s *wardenServer) sendUpdate(ad *warden.ClusterAdvertisement) {
 	}
 }
 
+func (s *wardenServer) journal(op journalOp, ad *warden.ClusterAdvertisement) {
+	// Note: callers must hold s.lock
+	err := s.store.Record(op, ad)
+	if err != nil {
+		fmt.Printf("Failed to journal %s of %s (%s): %v\n", op, ad.ClusterId, ad.ClusterType, err)
+	}
+}
+
+func (s *wardenServer) restore() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state, err := s.store.Load()
+	if err != nil {
+		return err
+	}
+	for k, ad := range state {
+		s.restored[k] = ad
+		if ad.RequestId != "" {
+			s.requests[ad.RequestId] = k
+		}
+		fmt.Println("Restored cluster:", ad)
+	}
+	if len(s.restored) > 0 {
+		time.AfterFunc(restoreWindow, s.dropRestored)
+	}
+	return nil
+}
+
+func (s *wardenServer) dropRestored() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, ad := range s.restored {
+		fmt.Println("Cluster was not re-advertised; dropping restored reservation:", ad)
+		if rId := ad.RequestId; rId != "" && s.requests[rId] == k {
+			delete(s.requests, rId)
+		}
+		delete(s.restored, k)
+		s.journal(opDelete, ad)
+	}
+}
+
+func (s *wardenServer) reconcile(cl *cluster) {
+	// Note: callers must hold s.lock
+	k := keyFromCluster(cl)
+	old, ok := s.restored[k]
+	if !ok {
+		return
+	}
+	delete(s.restored, k)
+	if old.RequestId == cl.ad.RequestId {
+		// agent agrees with the restored state
+		return
+	}
+	if cl.ad.RequestId == "" && old.RequestId != "" &&
+		cl.ad.ReservationInfo != nil && old.ReservationInfo != nil &&
+		cl.ad.ReservationInfo.UserName == old.ReservationInfo.UserName &&
+		(cl.ad.State == warden.ClusterAdvertisement_RESERVED || cl.ad.State == warden.ClusterAdvertisement_READY) {
+		// agent still holds the reservation, but does not track request ids; adopt the restored one
+		cl.ad.RequestId = old.RequestId
+		return
+	}
+	// the agent is the authority on its clusters; drop the restored reservation
+	fmt.Println("Agent does not agree with restored cluster; dropping:", old)
+	if rId := old.RequestId; rId != "" && s.requests[rId] == k {
+		delete(s.requests, rId)
+	}
+}
+
+func (s *wardenServer) sendWithdrawal(ad *warden.ClusterAdvertisement, reason warden.ClusterAdvertisement_Event_Reason, msg string) {
+	// Note: callers to this method should hold s.lock
+	// Send a copy, so that the event is not retained in the cluster's advertisement
+	w := *ad
+	w.State = warden.ClusterAdvertisement_UNAVAILABLE
+	w.Event = &warden.ClusterAdvertisement_Event{
+		Type:    warden.ClusterAdvertisement_Event_WITHDRAWN,
+		Reason:  reason,
+		Message: msg,
+	}
+	s.sendUpdate(&w)
+}
+
 func (s *wardenServer) updateCluster(cl *cluster) {
 	// Note: callers must hold s.lock
 	k := keyFromCluster(cl)
 	existing, ok := s.clusters[k]
+	if !ok {
+		s.reconcile(cl)
+	}
+	if ok && existing.stale() {
+		logAgent(cl.agent.Context(), "Recovered cluster "+cl.ad.ClusterId+" from "+cl.agent.reg.Name+" at", nil)
+	}
 	if ok && cl.ad.RequestId != existing.ad.RequestId {
+		// the agent may end a returned reservation before acknowledging the return
+		s.withdrawReturned(existing.ad.RequestId)
 		// reservation is no longer assocated with the old request; delete the mapping
 		delete(s.requests, existing.ad.RequestId)
+		delete(s.owners, existing.ad.RequestId)
+		delete(s.sessions, existing.ad.RequestId)
+		delete(s.charges, existing.ad.RequestId)
 	}
+	var prev *warden.ClusterAdvertisement
+	if ok {
+		prev = existing.ad
+	}
+	s.metrics.clusterUpdated(k, prev, cl.ad)
+	s.auditTransition(k, prev, cl.ad, "")
 	s.clusters[k] = *cl
+	s.journal(opUpdate, cl.ad)
+	s.scheduleExpiry(cl)
 	if cl.ad.RequestId != "" {
 		// update the request mapping (this is conservative, and likely won't change anything
 		s.requests[cl.ad.RequestId] = k
@@ -184,8 +397,8 @@ func (s *wardenServer) updateCluster(cl *cluster) {
 	if cl.ad.State == warden.ClusterAdvertisement_READY {
 		w, ok := s.waiters[k]
 		if ok {
-			for _, ch := range w {
-				ch <- cl.ad
+			for _, wt := range w {
+				wt.ch <- cl.ad
 			}
 			// Remove the waiters, now that they have been updated
 			delete(s.waiters, k)
@@ -194,66 +407,120 @@ func (s *wardenServer) updateCluster(cl *cluster) {
 
 	// Send update to all streaming clients
 	s.sendUpdate(cl.ad)
+
+	// Hand newly available clusters to queued requests
+	if cl.ad.State == warden.ClusterAdvertisement_AVAILABLE {
+		s.drainQueue()
+	}
 }
 
-func (s *wardenServer) deleteCluster(cl *cluster) {
+func (s *wardenServer) deleteCluster(cl *cluster, reason warden.ClusterAdvertisement_Event_Reason) {
 	// Note: callers must hold s.lock
 	k := keyFromCluster(cl)
 	delete(s.clusters, k)
+	s.journal(opDelete, cl.ad)
+	s.metrics.clusterUpdated(k, cl.ad, nil)
+	s.auditTransition(k, cl.ad, nil, "cluster was removed")
+	s.cancelExpiry(k)
 	if rId := cl.ad.RequestId; rId != "" {
 		delete(s.requests, rId)
-		//TODO need to send UNAVAILABLE
+		delete(s.owners, rId)
+		delete(s.sessions, rId)
+		delete(s.charges, rId)
+		delete(s.returns, rId)
 	}
+	s.sendWithdrawal(cl.ad, reason, "cluster was removed")
 
-	// Close all local waiters for this cluster
+	// Fail all local waiters for this cluster
 	w, ok := s.waiters[k]
 	if ok {
-		for _, ch := range w {
-			close(ch)
+		ad := failureAd(nil, k, cl.ad.RequestId, codes.Unavailable,
+			fmt.Sprintf("Cluster %s (%s) was removed", k.cId, k.cType))
+		for _, wt := range w {
+			wt.ch <- ad
 		}
-		// Remove the waiters, now that they have been closed
+		// Remove the waiters, now that they have been failed
 		delete(s.waiters, k)
 	}
 
 }
 
+// Deletes the cluster that its agent no longer hosts
+func (s *wardenServer) removeCluster(agent *agentConn, k key) {
+	// Note: callers must hold s.lock
+	cl, ok := s.clusters[k]
+	if !ok {
+		return
+	}
+	if cl.agent != agent {
+		fmt.Printf("Ignoring withdrawal of cluster %s from %s; it belongs to %s\n", k.cId, agent, cl.agent)
+		return
+	}
+	s.deleteCluster(&cl, warden.ClusterAdvertisement_Event_REMOVED)
+}
+
 func (s *wardenServer) AgentClusters(stream warden.ClusterAgentService_AgentClustersServer) error {
 	logAgent(stream.Context(), "New stream from", nil)
+	if err := s.authorizeAgent(stream.Context()); err != nil {
+		logAgent(stream.Context(), "Rejecting stream from", err)
+		return err
+	}
 
-	s.lock.Lock()
-	// register the stream into the inventory of active agent
-	s.agents[stream] = true
-	s.lock.Unlock()
+	// register the agent into the inventory of active agents
+	agent, err := s.registerAgent(stream)
+	if err != nil {
+		logAgent(stream.Context(), "Registration failed from", err)
+		return err
+	}
+	logAgent(stream.Context(), "Registered agent "+agent.String()+" from", nil)
 
 	// defer mechanism to prune the inventory
 	defer func() {
 		s.lock.Lock()
 		defer s.lock.Unlock()
 
-		// remove cells from the warden map when agent disappears
-		for _, cl := range s.clusters {
-			//TODO maybe we should time these out instead? in case, the agent is coming right back
-			if cl.agent == stream {
-				s.deleteCluster(&cl)
-			}
+		// remove cells from the warden map when agent disappears, unless it comes right back; an
+		// agent that has since registered again was already disconnected when it did
+		if s.agents[agent.reg.Name] == agent {
+			s.disconnectAgent(agent)
+			delete(s.agents, agent.reg.Name)
 		}
-		delete(s.agents, stream)
 	}()
 
 	// setup polling loop for receiving new cluster advertisements
 	for {
-		cl, err := stream.Recv()
+		msg, err := stream.Recv()
 		if err == io.EOF {
-			logAgent(stream.Context(), "EOF (close) from", nil)
+			logAgent(stream.Context(), "EOF (close) from "+agent.reg.Name+" at", nil)
 			return nil
 		}
 		if err != nil {
-			logAgent(stream.Context(), "Connection error from", err)
+			logAgent(stream.Context(), "Connection error from "+agent.reg.Name+" at", err)
 			return err
 		}
-		logAgent(stream.Context(), "Update from", cl)
+		if ack := msg.Ack; ack != nil {
+			logAgent(stream.Context(), "Ack from "+agent.reg.Name+" at", ack)
+			s.lock.Lock()
+			s.handleAck(agent, ack)
+			s.lock.Unlock()
+			continue
+		}
+		cl := msg.Advertisement
+		if cl == nil {
+			continue
+		}
+		if err := agent.checkAdvertisement(cl); err != nil {
+			logAgent(stream.Context(), "Ignoring update from", err)
+			continue
+		}
 		s.lock.Lock()
-		s.updateCluster(&cluster{cl, stream})
+		if cl.Event != nil && cl.Event.Type == warden.ClusterAdvertisement_Event_WITHDRAWN {
+			logAgent(stream.Context(), "Withdrawal from "+agent.reg.Name+" at", cl)
+			s.removeCluster(agent, key{cl.ClusterId, cl.ClusterType})
+		} else {
+			logAgent(stream.Context(), "Update from "+agent.reg.Name+" at", cl)
+			s.updateCluster(&cluster{ad: cl, agent: agent})
+		}
 		s.lock.Unlock()
 	}
 	return nil
@@ -268,6 +535,9 @@ func (s *wardenServer) lookupRequest(req *warden.ClusterRequest) (*cluster, bool
 		if !ok {
 			// this shouldn't happen, but we'll remove the stale request id to cluster id mapping
 			delete(s.requests, rId)
+			delete(s.owners, rId)
+			delete(s.sessions, rId)
+			delete(s.returns, rId)
 			return nil, false
 		}
 		return &ad, true
@@ -277,36 +547,56 @@ func (s *wardenServer) lookupRequest(req *warden.ClusterRequest) (*cluster, bool
 
 func (s *wardenServer) assignRequest(req *warden.ClusterRequest) (*cluster, bool) {
 	// Note: callers must hold s.lock
+	var best *cluster
 	for _, c := range s.clusters {
-		if req.ClusterType != "" && req.ClusterType != c.ad.ClusterType {
+		if !matches(req, c.ad) || !fits(req, c.ad) || c.stale() || !s.policy.allowsDuration(c.ad.ClusterType, req.Duration) {
 			continue
 		}
-		if req.ClusterId != "" && req.ClusterId != c.ad.ClusterId {
-			continue
-		}
-		// find the first one that is available
+		// find the available cluster that best fits the requested spec
 		if c.ad.State == warden.ClusterAdvertisement_AVAILABLE {
-			k := key{c.ad.ClusterId, c.ad.ClusterType}
-			// Update the request with cluster info
-			req.ClusterType = c.ad.ClusterType
-			req.ClusterId = c.ad.ClusterId
-
-			// Mark the cluster as reserved internally so that it is not reassigned
-			c.ad.State = warden.ClusterAdvertisement_RESERVED
-			c.ad.RequestId = req.RequestId
-			s.clusters[k] = c
-			s.requests[req.RequestId] = k
-			fmt.Println("Assigning cluster:", c.ad)
-			return &c, true
+			if best == nil || betterFit(c.ad, best.ad) {
+				c := c
+				best = &c
+			}
 		}
 	}
-	return nil, false
+	if best == nil {
+		return nil, false
+	}
+	c := *best
+	k := key{c.ad.ClusterId, c.ad.ClusterType}
+	// Update the request with cluster info
+	req.ClusterType = c.ad.ClusterType
+	req.ClusterId = c.ad.ClusterId
+
+	// Mark the cluster as reserved internally so that it is not reassigned
+	c.ad.State = warden.ClusterAdvertisement_RESERVED
+	c.ad.RequestId = req.RequestId
+	s.clusters[k] = c
+	s.requests[req.RequestId] = k
+	if req.Spec != nil {
+		s.owners[req.RequestId] = req.Spec.UserName
+	}
+	s.journal(opAssign, c.ad)
+	s.metrics.clusterReserved(k, req)
+	s.auditTransition(k, nil, c.ad, "")
+	if req.Spec != nil {
+		s.chargeRequest(req.RequestId, req.Spec.UserName, durationHours(req.Duration))
+	}
+	fmt.Println("Assigning cluster:", c.ad)
+	return &c, true
 }
 
-func (s *wardenServer) waitForReady(cl *cluster) (wait chan *warden.ClusterAdvertisement) {
+func (s *wardenServer) waitForReady(cl *cluster, rId string) (wait chan *warden.ClusterAdvertisement) {
 	// Note: callers must hold s.lock
 	// We allocate a buffered channel, so that we will not block if the cluster is already ready
 	wait = make(chan *warden.ClusterAdvertisement, 1)
+	s.notifyWhenReady(cl, rId, wait)
+	return wait
+}
+
+func (s *wardenServer) notifyWhenReady(cl *cluster, rId string, wait chan *warden.ClusterAdvertisement) {
+	// Note: callers must hold s.lock; wait must be buffered
 	if cl.ad.State == warden.ClusterAdvertisement_READY {
 		// cluster is already ready, return immediately
 		wait <- cl.ad
@@ -316,52 +606,139 @@ func (s *wardenServer) waitForReady(cl *cluster) (wait chan *warden.ClusterAdver
 	k := key{cl.ad.ClusterId, cl.ad.ClusterType}
 	l, ok := s.waiters[k]
 	if !ok {
-		l = []chan *warden.ClusterAdvertisement{wait}
+		l = []waiter{{rId, wait}}
 	} else {
-		l = append(l, wait)
+		l = append(l, waiter{rId, wait})
 	}
 	s.waiters[k] = l
-	return wait
 }
 
-func (s *wardenServer) processRequest(req *warden.ClusterRequest) (chan *warden.ClusterAdvertisement, error) {
+func (s *wardenServer) forwardRequest(cl *cluster, req *warden.ClusterRequest) error {
+	// Note: callers must hold s.lock
+	if cl.stale() {
+		return grpc.Errorf(codes.Unavailable, "Agent for cluster %s (%s) is disconnected; try again later",
+			cl.ad.ClusterId, cl.ad.ClusterType)
+	}
+	err := cl.agent.Send(req)
+	if err != nil {
+		return err
+	}
+	logAgent(cl.agent.Context(), "Sending request to", req)
+	s.awaitAck(cl, req)
+	return nil
+}
+
+// Processes the request made over the client stream, if any, and returns the channel of its reply
+func (s *wardenServer) processRequest(id identity, req *warden.ClusterRequest,
+	session warden.ClusterClientService_ServerClustersServer) (wait chan *warden.ClusterAdvertisement, err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	defer func() {
+		s.auditRequest(id, req, err)
+		if err != nil {
+			s.metrics.requestRejected(req.Type, grpc.Code(err))
+		}
+	}()
+
+	if err := s.authorizeRequest(id, req); err != nil {
+		return nil, err
+	}
 
 	var cl *cluster
 	var found bool
 
+	// Check to see if the request belongs to a restored cluster whose agent has not reconnected
+	if k, ok := s.requests[req.RequestId]; ok {
+		if _, pending := s.restored[k]; pending {
+			return nil, grpc.Errorf(codes.Unavailable, "Cluster %s (%s) for req %s has not been re-advertised yet",
+				k.cId, k.cType, req.RequestId)
+		}
+	}
+
 	// Check to see if we have already reserved a cluster for this request
 	cl, found = s.lookupRequest(req)
 
-	if !found && req.Type == warden.ClusterRequest_RESERVE {
-		// Assign the request to an available cluster
-		cl, found = s.assignRequest(req)
+	if !found {
+		switch req.Type {
+		case warden.ClusterRequest_RESERVE:
+			// Reject requests that no cluster could ever satisfy, rather than queue them forever
+			if err := s.checkSatisfiable(req); err != nil {
+				return nil, err
+			}
+			// Assign the request to an available cluster, or wait in line for one
+			if s.queue.find(req.RequestId) < 0 {
+				if err := s.checkReservePolicy(req); err != nil {
+					return nil, err
+				}
+				cl, found = s.assignRequest(req)
+			}
+			if !found {
+				s.bindRequest(req, session)
+				return s.enqueue(req), nil
+			}
+		case warden.ClusterRequest_STATUS:
+			if wait, ok := s.queuedStatus(req.RequestId); ok {
+				return wait, nil
+			}
+		case warden.ClusterRequest_RETURN:
+			if ad, ok := s.dequeue(req.RequestId); ok {
+				delete(s.sessions, req.RequestId)
+				// Request was still waiting; reply with its last queued state
+				wait := make(chan *warden.ClusterAdvertisement, 1)
+				wait <- ad
+				return wait, nil
+			}
+		}
 	}
 	if !found {
-		return nil, fmt.Errorf("No available clusters for req %s", req.RequestId)
+		return nil, grpc.Errorf(codes.NotFound, "No cluster found for req %s", req.RequestId)
+	}
+
+	if req.Type == warden.ClusterRequest_EXTEND {
+		if err := s.checkExtendPolicy(cl, req); err != nil {
+			return nil, err
+		}
 	}
 
 	// Forward the request to the agent, except for status requests
 	if req.Type != warden.ClusterRequest_STATUS {
-		err := cl.agent.Send(req)
+		s.bindRequest(req, session)
+		err := s.forwardRequest(cl, req)
 		if err != nil {
 			return nil, err
-		} else {
-			logAgent(cl.agent.Context(), "Sending request to", req)
 		}
 	}
+	var user string
+	if cl.ad.ReservationInfo != nil {
+		user = cl.ad.ReservationInfo.UserName
+	}
+	switch req.Type {
+	case warden.ClusterRequest_EXTEND:
+		// the agent extends the reservation to the requested duration from now
+		s.chargeRequest(req.RequestId, user, durationHours(req.Duration)-remainingHours(cl.ad))
+	case warden.ClusterRequest_RETURN:
+		delete(s.sessions, req.RequestId)
+		// give back the unused part of the reservation, unless the agent fails the return
+		s.chargeRequest(req.RequestId, user, -remainingHours(cl.ad))
+		s.returns[req.RequestId] = keyFromCluster(cl)
+	}
 
 	// Wait for the cluster to become ready
-	return s.waitForReady(cl), nil
+	return s.waitForReady(cl, req.RequestId), nil
 }
 
-func (s *wardenServer) returnCluster(cl *cluster) {
+func (s *wardenServer) returnCluster(cl *cluster, reason warden.ClusterAdvertisement_Event_Reason, msg string) {
 	// Note: callers must hold s.lock
 	// Mark the cluster as unavailable internally in case a client asks
 	k := keyFromCluster(cl)
 	cl.ad.State = warden.ClusterAdvertisement_UNAVAILABLE
 	s.clusters[k] = *cl
+	s.journal(opUpdate, cl.ad)
+	s.auditTransition(k, nil, cl.ad, msg)
+	s.cancelExpiry(k)
+	// the reservation is over, so a later one with the same RequestId is not bound to its session
+	delete(s.sessions, cl.ad.RequestId)
+	s.sendWithdrawal(cl.ad, reason, msg)
 
 	// Build minimal request based on cluster advertisement
 	req := warden.ClusterRequest{
@@ -374,56 +751,141 @@ func (s *wardenServer) returnCluster(cl *cluster) {
 	cl.agent.Send(&req)
 }
 
-func (s *wardenServer) cleanupStaleClusters() {
-	for {
-		s.lock.Lock()
-		for _, cl := range s.clusters {
-			switch cl.ad.State {
-			case warden.ClusterAdvertisement_RESERVED:
-				fallthrough
-			case warden.ClusterAdvertisement_READY:
-				info := cl.ad.ReservationInfo
-				if info != nil {
-					if info.Duration < 0 {
-						// Reservation does not expire
-						continue
-					}
-					end := time.Unix(info.ReservationStartTime, 0)
-					end = end.Add(time.Duration(info.Duration) * time.Minute)
-					if end.Before(time.Now()) {
-						fmt.Println("Reservation expired:", cl.ad)
-						s.returnCluster(&cl)
-						continue
-					} else {
-						fmt.Println("Time remaining in seconds", cl.ad.ClusterId, cl.ad.ClusterType, end.Sub(time.Now()))
-
-					}
-				}
-			}
-		}
-		s.lock.Unlock()
-		time.Sleep(20 * time.Second)
-	}
-}
-
-func newServer() *wardenServer {
+func newServer(store stateStore, expiryWarnings []time.Duration) *wardenServer {
 	s := new(wardenServer)
+	s.store = store
+	s.restored = make(map[key]*warden.ClusterAdvertisement)
 	s.clusters = make(map[key]cluster)
 	s.requests = make(map[string]key)
-	s.clients = make(map[warden.ClusterClientService_ServerClustersServer]bool)
-	s.agents = make(map[warden.ClusterAgentService_AgentClustersServer]bool)
-	s.waiters = make(map[key][]chan *warden.ClusterAdvertisement)
+	s.owners = make(map[string]string)
+	s.clients = make(map[recvAd]bool)
+	s.agents = make(map[string]*agentConn)
+	s.waiters = make(map[key][]waiter)
+	s.tokens = make(map[string]string)
+	s.admins = make(map[string]bool)
+	s.expiry = newExpiryScheduler(expiryWarnings)
+	s.expiryWarning = s.warnHolder
+	s.policy = new(policy)
+	s.usage = make(map[string]*usage)
+	s.charges = make(map[string]charge)
+	s.sessions = make(map[string]warden.ClusterClientService_ServerClustersServer)
+	s.pendingAcks = make(map[string]*pendingAck)
+	s.returns = make(map[string]key)
+	s.metrics = newMetrics()
+	s.auditLog = nopAudit{}
 	return s
 }
 
 func main() {
+	statePath := flag.String("state", "warden.journal", "file used to persist reservation state; empty to disable")
+	auditPath := flag.String("audit", "warden.audit", "file to which requests and cluster transitions are appended; empty to disable")
+	tlsFlags := util.AddTLSFlags()
+	agentCA := flag.String("agentCA", "", "PEM CA bundle that issues agent certificates, apart from the users' -tlsCA; required with TLS")
+	userAuth := flag.Bool("userAuth", false, "require clients to identify themselves with a certificate or token")
+	tokenFile := flag.String("tokens", "", "file of \"<user> <token>\" lines used to identify clients")
+	adminList := flag.String("admins", "", "comma-separated users that may act on any reservation")
+	agentGrace := flag.Duration("agentGrace", time.Minute, "time to wait for a disconnected agent to return before removing its clusters")
+	warningList := flag.String("expiryWarnings", "15m,5m", "comma-separated times before the end of a reservation at which its holder is warned")
+	webhook := flag.String("notifyWebhook", "", "URL to which expiry warnings are posted as JSON")
+	smtpAddr := flag.String("smtp", "", "host:port of the SMTP relay used to mail expiry warnings")
+	mailFrom := flag.String("mailFrom", "warden@localhost", "sender of mailed expiry warnings")
+	mailDomain := flag.String("mailDomain", "", "domain appended to user names to mail expiry warnings")
+	ackTimeout := flag.Duration("ackTimeout", 30*time.Second, "time to wait for an agent to acknowledge a request before failing it; 0 to disable")
+	sessionGrace := flag.Duration("sessionGrace", 30*time.Second, "time to wait for a client to return before releasing its session-bound reservations")
+	httpAddr := flag.String("http", "", "address on which to serve the HTTP/JSON gateway, e.g. :8080; empty to disable")
+	policyFile := flag.String("policy", "", "JSON file of reservation limits; see README")
+	flag.Parse()
+
+	tokens, err := loadTokens(*tokenFile)
+	if err != nil {
+		grpclog.Fatalf("failed to load tokens: %v", err)
+	}
+	if *userAuth && len(tokens) == 0 && !tlsFlags.Enabled() {
+		grpclog.Fatalf("-userAuth requires -tokens or TLS client certificates")
+	}
+
+	var opts []grpc.ServerOption
+	if tlsFlags.Enabled() {
+		if *agentCA == "" {
+			grpclog.Fatalf("-agentCA is required to verify agent certificates")
+		}
+		tlsFlags.ClientCAFiles = []string{*agentCA}
+		creds, err := tlsFlags.ServerCredentials()
+		if err != nil {
+			grpclog.Fatalf("failed to load TLS credentials: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	} else {
+		fmt.Println("Warning: serving without TLS; agents and clients are not authenticated")
+	}
+
+	var expiryWarnings []time.Duration
+	for _, w := range strings.Split(*warningList, ",") {
+		if w = strings.TrimSpace(w); w == "" {
+			continue
+		}
+		d, err := time.ParseDuration(w)
+		if err != nil {
+			grpclog.Fatalf("invalid expiry warning %q: %v", w, err)
+		}
+		expiryWarnings = append(expiryWarnings, d)
+	}
+
+	policy, err := loadPolicy(*policyFile)
+	if err != nil {
+		grpclog.Fatalf("failed to load policy: %v", err)
+	}
+
+	notifier, err := newNotifier(*webhook, *smtpAddr, *mailFrom, *mailDomain)
+	if err != nil {
+		grpclog.Fatalf("failed to set up notifications: %v", err)
+	}
+
+	store, err := newStateStore(*statePath)
+	if err != nil {
+		grpclog.Fatalf("failed to open state store: %v", err)
+	}
+	defer store.Close()
+
+	audit, err := newAuditLog(*auditPath)
+	if err != nil {
+		grpclog.Fatalf("failed to open audit log: %v", err)
+	}
+	defer audit.Close()
+
 	lis, err := net.Listen("tcp", ":1234")
 	if err != nil {
 		grpclog.Fatalf("failed to listen: %v", err)
 	}
-	grpcServer := grpc.NewServer()
-	s := newServer()
-	go s.cleanupStaleClusters()
+	grpcServer := grpc.NewServer(opts...)
+	s := newServer(store, expiryWarnings)
+	if tlsFlags.Enabled() {
+		if s.agentCAs, err = util.LoadCertPool(*agentCA); err != nil {
+			grpclog.Fatalf("failed to load agent CA: %v", err)
+		}
+		if s.userCAs, err = util.LoadCertPool(tlsFlags.CAFile); err != nil {
+			grpclog.Fatalf("failed to load CA: %v", err)
+		}
+	}
+	s.userAuth = *userAuth
+	s.auditLog = audit
+	s.agentGrace = *agentGrace
+	s.sessionGrace = *sessionGrace
+	s.ackTimeout = *ackTimeout
+	s.notifier = notifier
+	s.policy = policy
+	s.tokens = tokens
+	for _, a := range strings.Split(*adminList, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			s.admins[a] = true
+		}
+	}
+	if err := s.restore(); err != nil {
+		grpclog.Fatalf("failed to restore state: %v", err)
+	}
+	if *httpAddr != "" {
+		go s.serveHTTP(*httpAddr, tlsFlags)
+	}
 	warden.RegisterClusterClientServiceServer(grpcServer, s)
 	warden.RegisterClusterAgentServiceServer(grpcServer, s)
 	fmt.Println("starting to serve...")
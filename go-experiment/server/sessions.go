@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"time"
+)
+
+// Binds a session-bound request to the client stream it was made over
+func (s *wardenServer) bindSession(rId string, stream warden.ClusterClientService_ServerClustersServer) {
+	// Note: callers must hold s.lock
+	if _, ok := s.sessions[rId]; !ok {
+		logClient(stream.Context(), "Binding request "+rId+" to the session of", nil)
+	}
+	s.sessions[rId] = stream
+}
+
+// Binds the reserve request to the client stream it was made over, if it asks to be; this is done
+// before the request is forwarded or queued, so that the session cannot close unnoticed meanwhile
+func (s *wardenServer) bindRequest(req *warden.ClusterRequest, session warden.ClusterClientService_ServerClustersServer) {
+	// Note: callers must hold s.lock
+	if session != nil && req.Type == warden.ClusterRequest_RESERVE && req.SessionBound {
+		s.bindSession(req.RequestId, session)
+	}
+}
+
+// Starts the grace period of the requests bound to a client stream that has closed; requests that
+// are not re-bound by a new stream or returned in the meantime are released
+func (s *wardenServer) closeSession(stream warden.ClusterClientService_ServerClustersServer) {
+	// Note: callers must hold s.lock
+	for rId, st := range s.sessions {
+		if st != stream {
+			continue
+		}
+		fmt.Printf("Session of request %s closed; releasing it in %v unless the client returns\n", rId, s.sessionGrace)
+		rId := rId
+		time.AfterFunc(s.sessionGrace, func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if s.sessions[rId] == stream {
+				s.releaseSession(rId)
+			}
+		})
+	}
+}
+
+func (s *wardenServer) releaseSession(rId string) {
+	// Note: callers must hold s.lock
+	delete(s.sessions, rId)
+	if _, ok := s.dequeue(rId); ok {
+		return
+	}
+	if cl, ok := s.lookupRequest(&warden.ClusterRequest{RequestId: rId}); ok {
+		fmt.Println("Releasing reservation of closed session:", cl.ad)
+		s.returnCluster(cl, warden.ClusterAdvertisement_Event_SESSION_CLOSED, "client session closed")
+	}
+}
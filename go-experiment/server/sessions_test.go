@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+// Client stream that only carries its context
+type contextClientStream struct {
+	warden.ClusterClientService_ServerClustersServer
+}
+
+func (s *contextClientStream) Context() context.Context {
+	return context.Background()
+}
+
+func TestBindSession(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	stream := &sendingAgentStream{}
+	agent := &agentConn{stream: stream, reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	s.clusters[key{"a", "dummy"}] = cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}}
+	session := &contextClientStream{}
+
+	// the request is bound by the time it is forwarded, and so is the one queued behind it
+	for _, rId := range []string{"r1", "r2"} {
+		req := &warden.ClusterRequest{RequestId: rId, Type: warden.ClusterRequest_RESERVE, Duration: 60, SessionBound: true}
+		if _, err := s.processRequest(identity{admin: true}, req, session); err != nil {
+			t.Fatal(err)
+		}
+		if s.sessions[rId] != session {
+			t.Errorf("Expected %s to be bound to the session", rId)
+		}
+	}
+	if s.queue.find("r2") < 0 {
+		t.Error("Expected r2 to be queued")
+	}
+
+	// requests that are not session-bound, or not made over a stream, are not bound
+	req := &warden.ClusterRequest{RequestId: "r3", Type: warden.ClusterRequest_RESERVE, Duration: 60}
+	if _, err := s.processRequest(identity{admin: true}, req, session); err != nil {
+		t.Fatal(err)
+	}
+	req = &warden.ClusterRequest{RequestId: "r4", Type: warden.ClusterRequest_RESERVE, Duration: 60, SessionBound: true}
+	if _, err := s.processRequest(identity{admin: true}, req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.sessions["r3"]; ok {
+		t.Error("Expected r3 not to be bound")
+	}
+	if _, ok := s.sessions["r4"]; ok {
+		t.Error("Expected r4 not to be bound")
+	}
+}
+
+func TestExpiredSessionIsUnbound(t *testing.T) {
+	s := newServer(nopStore{}, nil)
+	s.sessionGrace = time.Millisecond
+	agent := &agentConn{stream: &sendingAgentStream{}, reg: &warden.AgentRegistration{Name: "a", ClusterType: "dummy"}}
+	k := key{"a", "dummy"}
+	s.clusters[k] = cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}}
+	old := &contextClientStream{}
+
+	req := &warden.ClusterRequest{RequestId: "tom", Type: warden.ClusterRequest_RESERVE, Duration: 60, SessionBound: true}
+	if _, err := s.processRequest(identity{user: "tom"}, req, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reservation expires, and the agent makes the cluster available again
+	cl := s.clusters[k]
+	s.returnCluster(&cl, warden.ClusterAdvertisement_Event_EXPIRED, "reservation expired")
+	if _, ok := s.sessions["tom"]; ok {
+		t.Error("Expected the expired reservation to be unbound")
+	}
+	s.updateCluster(&cluster{agent: agent, ad: &warden.ClusterAdvertisement{
+		ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}})
+
+	// tom reserves again with the same id, outside of any session, and then the old stream closes
+	req = &warden.ClusterRequest{RequestId: "tom", Type: warden.ClusterRequest_RESERVE, Duration: 60}
+	if _, err := s.processRequest(identity{user: "tom"}, req, nil); err != nil {
+		t.Fatal(err)
+	}
+	s.lock.Lock()
+	s.closeSession(old)
+	s.lock.Unlock()
+	time.Sleep(20 * time.Millisecond)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ad := s.clusters[k].ad; ad.State != warden.ClusterAdvertisement_RESERVED || ad.RequestId != "tom" {
+		t.Errorf("Expected the new reservation to outlive the old session, got %v", ad)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"os"
+	"time"
+)
+
+type journalOp string
+
+const (
+	opUpdate journalOp = "update"
+	opDelete journalOp = "delete"
+	opAssign journalOp = "assign"
+)
+
+// Entry in the reservation state journal; one is written for each cluster transition
+type journalEntry struct {
+	Op   journalOp                    `json:"op"`
+	Time int64                        `json:"time"` // seconds since epoch
+	Ad   *warden.ClusterAdvertisement `json:"ad"`
+}
+
+// Persists the reservation state of the server so that it can be restored after a restart
+type stateStore interface {
+	// Returns the last recorded advertisement for each cluster that was not deleted
+	Load() (map[key]*warden.ClusterAdvertisement, error)
+	// Appends a cluster transition to the store, unless it leaves the stored state as is
+	Record(op journalOp, ad *warden.ClusterAdvertisement) error
+	Close() error
+}
+
+// Store that keeps nothing; used when persistence is disabled
+type nopStore struct{}
+
+func (nopStore) Load() (map[key]*warden.ClusterAdvertisement, error) {
+	return make(map[key]*warden.ClusterAdvertisement), nil
+}
+
+func (nopStore) Record(op journalOp, ad *warden.ClusterAdvertisement) error {
+	return nil
+}
+
+func (nopStore) Close() error {
+	return nil
+}
+
+// Number of entries appended to the journal after which it is compacted
+const compactAfter = 1000
+
+// Store that appends transitions to a local journal file, one JSON entry per line
+type fileStore struct {
+	path string
+	f    *os.File
+
+	// journaled state of each cluster, and the entries appended since the journal was last compacted
+	state        map[key]*warden.ClusterAdvertisement
+	appended     int
+	compactAfter int
+}
+
+// Opens (or creates) the journal at the given path; an empty path disables persistence
+func newStateStore(path string) (stateStore, error) {
+	if path == "" {
+		return nopStore{}, nil
+	}
+	return &fileStore{path: path, compactAfter: compactAfter}, nil
+}
+
+func (s *fileStore) Load() (map[key]*warden.ClusterAdvertisement, error) {
+	state := make(map[key]*warden.ClusterAdvertisement)
+	f, err := os.Open(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			var e journalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Ad == nil {
+				// a torn write at the end of the journal is expected after a crash; skip it
+				fmt.Printf("Skipping bad journal entry %s:%d: %v\n", s.path, line, err)
+				continue
+			}
+			k := key{e.Ad.ClusterId, e.Ad.ClusterType}
+			switch e.Op {
+			case opUpdate, opAssign:
+				state[k] = e.Ad
+			case opDelete:
+				delete(state, k)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Compact the journal so that it only holds the restored state
+	if err := s.rewrite(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Replaces the journal with one that only holds the given state, and reopens it for appending
+func (s *fileStore) rewrite(state map[key]*warden.ClusterAdvertisement) error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	now := time.Now().Unix()
+	for _, ad := range state {
+		if err := enc.Encode(journalEntry{opUpdate, now, ad}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	s.f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	s.state = make(map[key]*warden.ClusterAdvertisement, len(state))
+	for k, ad := range state {
+		s.state[k] = journaled(ad)
+	}
+	s.appended = 0
+	return nil
+}
+
+// Returns the part of the advertisement that is journaled; the estimated cost of a reservation
+// changes with every poll of its agent, and is not needed to restore the reservation
+func journaled(ad *warden.ClusterAdvertisement) *warden.ClusterAdvertisement {
+	// copy the advertisement, since the server goes on to update it in place
+	j := *ad
+	if ad.ReservationInfo != nil {
+		info := *ad.ReservationInfo
+		info.EstimatedCost = 0
+		j.ReservationInfo = &info
+	}
+	return &j
+}
+
+// Returns true if both advertisements journal the same way
+func sameAd(a, b *warden.ClusterAdvertisement) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	return err == nil && bytes.Equal(ja, jb)
+}
+
+func (s *fileStore) Record(op journalOp, ad *warden.ClusterAdvertisement) error {
+	if s.f == nil {
+		return fmt.Errorf("state journal %s is not open", s.path)
+	}
+	k := key{ad.ClusterId, ad.ClusterType}
+	old, ok := s.state[k]
+	if op == opDelete {
+		if !ok {
+			return nil
+		}
+	} else {
+		ad = journaled(ad)
+		if ok && sameAd(old, ad) {
+			// nothing to restore has changed since the last entry of the cluster
+			return nil
+		}
+	}
+	b, err := json.Marshal(journalEntry{op, time.Now().Unix(), ad})
+	if err != nil {
+		return err
+	}
+	_, err = s.f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	if op == opDelete {
+		delete(s.state, k)
+	} else {
+		s.state[k] = ad
+	}
+	if s.appended++; s.appended >= s.compactAfter {
+		return s.rewrite(s.state)
+	}
+	return s.f.Sync()
+}
+
+func (s *fileStore) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
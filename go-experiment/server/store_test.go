@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "warden.journal")
+
+	store, err := newStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != 0 {
+		t.Errorf("Expected empty state, got %v", state)
+	}
+
+	a := &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}
+	b := &warden.ClusterAdvertisement{ClusterId: "b", ClusterType: "dummy", State: warden.ClusterAdvertisement_AVAILABLE}
+	store.Record(opUpdate, a)
+	store.Record(opUpdate, b)
+	store.Record(opAssign, &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "dummy",
+		State: warden.ClusterAdvertisement_RESERVED, RequestId: "tom"})
+	store.Record(opDelete, b)
+	store.Close()
+
+	// append a torn entry to make sure it is skipped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"update","ad":{"clusterId":`)
+	f.Close()
+
+	for i := 0; i < 2; i++ {
+		store, err = newStateStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err = store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+		if len(state) != 1 {
+			t.Fatalf("Load %d: expected 1 cluster, got %v", i, state)
+		}
+		ad, ok := state[key{"a", "dummy"}]
+		if !ok || ad.RequestId != "tom" || ad.State != warden.ClusterAdvertisement_RESERVED {
+			t.Errorf("Load %d: expected reserved cluster a, got %v", i, ad)
+		}
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "warden.journal")
+
+	store, err := newStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.(*fileStore).compactAfter = 3
+	if _, err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	lines := func() int {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Count(b, []byte("\n"))
+	}
+
+	// re-advertising a cluster, or updating the cost of its reservation, is not journaled
+	ad := func(cost float64) *warden.ClusterAdvertisement {
+		return &warden.ClusterAdvertisement{ClusterId: "a", ClusterType: "ec2", State: warden.ClusterAdvertisement_READY,
+			RequestId: "tom", ReservationInfo: &warden.ClusterAdvertisement_ReservationInfo{
+				UserName: "tom", Duration: 60, EstimatedCost: cost}}
+	}
+	store.Record(opUpdate, ad(0.1))
+	store.Record(opUpdate, ad(0.2))
+	store.Record(opUpdate, ad(0.2))
+	store.Record(opDelete, &warden.ClusterAdvertisement{ClusterId: "b", ClusterType: "ec2"})
+	if n := lines(); n != 1 {
+		t.Errorf("Expected 1 journal entry, got %d", n)
+	}
+
+	// the journal is compacted to the current state once enough entries are appended
+	b := &warden.ClusterAdvertisement{ClusterId: "b", ClusterType: "ec2", State: warden.ClusterAdvertisement_AVAILABLE}
+	store.Record(opUpdate, b)
+	store.Record(opDelete, b)
+	if n := lines(); n != 1 {
+		t.Errorf("Expected the journal to be compacted to 1 entry, got %d", n)
+	}
+	store.Record(opUpdate, b)
+	if n := lines(); n != 2 {
+		t.Errorf("Expected entries to be appended after compaction, got %d", n)
+	}
+	store.Close()
+
+	store, err = newStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if len(state) != 2 || state[key{"a", "ec2"}].ReservationInfo.EstimatedCost != 0 {
+		t.Errorf("Expected clusters a and b without costs, got %v", state)
+	}
+}
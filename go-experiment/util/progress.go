@@ -0,0 +1,27 @@
+package util
+
+import (
+	"fmt"
+	"github.com/opennetworkinglab/onos-warden/warden"
+	"strings"
+	"time"
+)
+
+// Width of the bar drawn for progress events with a known number of steps
+const progressBarWidth = 20
+
+// Renders a progress event as a line showing the time since the request started and, if the
+// number of steps is known, a bar; e.g. "[  1m05s] [############        ] 3/5 node 3/5 ready"
+func FormatProgress(start time.Time, ev *warden.ClusterAdvertisement_Event) string {
+	elapsed := time.Since(start).Round(time.Second)
+	if ev.Steps == 0 {
+		return fmt.Sprintf("[%8v] %s", elapsed, ev.Message)
+	}
+	step := ev.Step
+	if step > ev.Steps {
+		step = ev.Steps
+	}
+	done := int(step) * progressBarWidth / int(ev.Steps)
+	bar := strings.Repeat("#", done) + strings.Repeat(" ", progressBarWidth-done)
+	return fmt.Sprintf("[%8v] [%s] %d/%d %s", elapsed, bar, step, ev.Steps, ev.Message)
+}
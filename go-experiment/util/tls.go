@@ -0,0 +1,141 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+)
+
+// Locations of the certificates and keys used to secure gRPC connections
+type TLSFlags struct {
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string
+	// additional CA bundles trusted to sign client certificates, e.g. the agents' CA; set by
+	// servers before they load their credentials
+	ClientCAFiles []string
+}
+
+// Registers the TLS flags on the default flag set; call before flag.Parse()
+func AddTLSFlags() *TLSFlags {
+	f := new(TLSFlags)
+	flag.StringVar(&f.CertFile, "tlsCert", "", "PEM certificate file presented to the peer")
+	flag.StringVar(&f.KeyFile, "tlsKey", "", "PEM private key file for -tlsCert")
+	flag.StringVar(&f.CAFile, "tlsCA", "", "PEM CA bundle used to verify the peer's certificate")
+	flag.StringVar(&f.ServerName, "tlsServerName", "", "overrides the server name expected in the warden's certificate")
+	return f
+}
+
+// Returns true if any TLS material was provided
+func (f *TLSFlags) Enabled() bool {
+	return f.CertFile != "" || f.KeyFile != "" || f.CAFile != ""
+}
+
+func (f *TLSFlags) certificates() ([]tls.Certificate, error) {
+	if f.CertFile == "" && f.KeyFile == "" {
+		return nil, nil
+	}
+	if f.CertFile == "" || f.KeyFile == "" {
+		return nil, errors.New("-tlsCert and -tlsKey must be provided together")
+	}
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+func (f *TLSFlags) certPool() (*x509.CertPool, error) {
+	return LoadCertPool(f.CAFile)
+}
+
+// Returns a pool of the certificates in the given PEM bundles, skipping empty paths; returns nil
+// if no bundle was given
+func LoadCertPool(paths ...string) (*x509.CertPool, error) {
+	var pool *x509.CertPool
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", path)
+		}
+	}
+	return pool, nil
+}
+
+// Returns server credentials that verify client certificates against the CA bundle and the
+// ClientCAFiles, if they are presented; callers decide which services require a verified
+// certificate, and from which CA.
+func (f *TLSFlags) ServerCredentials() (credentials.TransportCredentials, error) {
+	config, err := f.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// Returns the TLS configuration behind ServerCredentials, for servers other than gRPC
+func (f *TLSFlags) ServerConfig() (*tls.Config, error) {
+	certs, err := f.certificates()
+	if err != nil {
+		return nil, err
+	}
+	if certs == nil {
+		return nil, errors.New("-tlsCert and -tlsKey are required to serve TLS")
+	}
+	pool, err := LoadCertPool(append([]string{f.CAFile}, f.ClientCAFiles...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: certs,
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+// Returns client credentials that present the certificate, if any, and verify the server
+// against the CA bundle (or the system roots, if no bundle was given)
+func (f *TLSFlags) ClientCredentials() (credentials.TransportCredentials, error) {
+	certs, err := f.certificates()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := f.certPool()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: certs,
+		RootCAs:      pool,
+		ServerName:   f.ServerName,
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// Returns the dial option for connecting to the warden; the connection is insecure if no TLS
+// material was provided
+func (f *TLSFlags) DialOption() (grpc.DialOption, error) {
+	if !f.Enabled() {
+		return grpc.WithInsecure(), nil
+	}
+	creds, err := f.ClientCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(creds), nil
+}
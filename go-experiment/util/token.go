@@ -0,0 +1,27 @@
+package util
+
+import (
+	"context"
+	"flag"
+	"os"
+)
+
+// Metadata key carrying the bearer token of a warden user
+const TokenHeader = "authorization"
+
+// Per-RPC credentials that identify the user to the warden with a bearer token
+type TokenCredentials string
+
+func (t TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{TokenHeader: "Bearer " + string(t)}, nil
+}
+
+// Tokens are allowed over insecure connections so that the warden can be used without TLS in the lab
+func (t TokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// Registers the -token flag on the default flag set; defaults to $WARDEN_TOKEN
+func AddTokenFlag() *string {
+	return flag.String("token", os.Getenv("WARDEN_TOKEN"), "token identifying the user to the warden; defaults to $WARDEN_TOKEN")
+}